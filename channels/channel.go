@@ -1,12 +1,14 @@
 package channels
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
 )
 
 const (
@@ -61,9 +63,13 @@ func (c *Coordinator) Start() {
 
 func (c *Coordinator) subscriptions(event *models.Event) ([]*models.Subscription, error) {
 	subscriptions := []*models.Subscription{}
-	res := c.database.Table("subscriptions").Select("subscriptions.*").Joins("right join users ON subscriptions.user_id=users.id").Where("minimum_priority <= ?", event.Priority)
+	res := c.database.Table("subscriptions").Select("subscriptions.*").Joins("right join users ON subscriptions.user_id=users.id").
+		Where("minimum_priority <= ? AND subscriptions.deleted_at IS NULL AND users.deleted_at IS NULL AND users.deactivated = ?", event.Priority, false)
 	if event.Group != nil {
-		res = res.Where("\"users\".\"group\" = ?", *event.Group)
+		res = res.Where("\"users\".\"id\" IN ("+models.GroupMembersQuery+")", *event.Group, *event.Group)
+	}
+	if len(event.Users) > 0 {
+		res = res.Where("\"users\".\"id\" IN (?)", []int64(event.Users))
 	}
 	res = res.Find(&subscriptions)
 	if res.Error != nil {
@@ -72,6 +78,15 @@ func (c *Coordinator) subscriptions(event *models.Event) ([]*models.Subscription
 	return subscriptions, nil
 }
 
+// Deliver sends the event through the subscription's channel only, regardless of its minimum priority
+func (c *Coordinator) Deliver(sub *models.Subscription, event *models.Event) error {
+	ch, ok := c.channels[sub.Channel]
+	if !ok {
+		return models.ErrSubscriptionChannelInvalid
+	}
+	return ch.Send(sub, event)
+}
+
 func (c *Coordinator) Send(event *models.Event) error {
 	select {
 	case c.bufferChannel <- event:
@@ -84,3 +99,27 @@ func (c *Coordinator) Send(event *models.Event) error {
 func (c *Coordinator) Stop() {
 	close(c.bufferChannel)
 }
+
+// digestClasses decodes classes of a digest event, it returns false for other events so they're rendered plainly
+func digestClasses(event *models.Event) ([]*timetable.Class, bool) {
+	if event.Payload == nil || event.Payload.Kind != models.EventPayloadTimetableDigest {
+		return nil, false
+	}
+	classes := []*timetable.Class{}
+	if err := json.Unmarshal(event.Payload.Classes, &classes); err != nil || len(classes) == 0 {
+		return nil, false
+	}
+	return classes, true
+}
+
+// timetableChanges decodes changes of a timetable change event, it returns false for other events so they're rendered plainly
+func timetableChanges(event *models.Event) (timetable.TimetableDiff, bool) {
+	if event.Payload == nil || event.Payload.Kind != models.EventPayloadTimetableChange {
+		return nil, false
+	}
+	diff := timetable.TimetableDiff{}
+	if err := json.Unmarshal(event.Payload.Changes, &diff); err != nil || len(diff) == 0 {
+		return nil, false
+	}
+	return diff, true
+}
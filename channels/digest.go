@@ -0,0 +1,149 @@
+package channels
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
+)
+
+// digestInterval is how often subscriptions are checked for due digests, digest times have a minute precision
+const digestInterval = time.Minute
+
+// Digests sends subscribers overviews of their classes of the day or the following week at the time they chose.
+// Digests go only through the subscription they were chosen for and are skipped if there are no classes.
+type Digests struct {
+	Database  *gorm.DB
+	Timetable *timetable.Coordinator
+	Channels  *Coordinator
+	Logger    *log.Logger
+	// sentUntil is the wall clock time digests were last sent up to
+	sentUntil time.Time
+}
+
+func (d *Digests) Start() {
+	d.sentUntil = timetable.LocalNow().Truncate(time.Minute)
+	ticker := time.NewTicker(digestInterval)
+	for range ticker.C {
+		if err := d.send(); err != nil {
+			d.Logger.Printf("could not send digests: %s\n", err.Error())
+		}
+	}
+}
+
+// send delivers digests due in every minute since the previous run, if subscriptions can't be loaded they are sent on the next run
+func (d *Digests) send() error {
+	now := timetable.LocalNow().Truncate(time.Minute)
+	since := d.sentUntil
+
+	subs := []*models.Subscription{}
+	res := d.Database.Table("subscriptions").Select("subscriptions.*").Joins("join users ON subscriptions.user_id=users.id").
+		Where("subscriptions.deleted_at IS NULL AND users.deleted_at IS NULL AND users.deactivated = ? AND subscriptions.digest IN (?)", false, []string{string(models.DigestDaily), string(models.DigestWeekly)}).
+		Find(&subs)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	users := map[uint]*models.User{}
+	for at := since.Add(time.Minute); !at.After(now); at = at.Add(time.Minute) {
+		for _, sub := range subs {
+			if !sub.DigestDue(at) {
+				continue
+			}
+			user, ok := users[sub.UserID]
+			if !ok {
+				user = &models.User{}
+				if res := d.Database.First(user, sub.UserID); res.Error != nil {
+					d.Logger.Printf("could not load user %d for a digest: %s\n", sub.UserID, res.Error.Error())
+					continue
+				}
+				if err := user.LoadGroups(d.Database); err != nil {
+					d.Logger.Printf("could not load groups of user %d for a digest: %s\n", sub.UserID, err.Error())
+					continue
+				}
+				users[sub.UserID] = user
+			}
+			if err := d.deliver(sub, user, at); err != nil {
+				d.Logger.Printf("could not send digest of subscription %d: %s\n", sub.ID, err.Error())
+			}
+		}
+	}
+	d.sentUntil = now
+	return nil
+}
+
+// deliver renders the digest of the subscription due at the time and sends it through the subscription's channel
+func (d *Digests) deliver(sub *models.Subscription, user *models.User, at time.Time) error {
+	classes, err := d.classes(sub.Digest, user, at)
+	if err != nil || len(classes) == 0 {
+		return err
+	}
+
+	pri := models.EventPriorityLow
+	event := &models.Event{
+		Priority: &pri,
+		Users:    pq.Int64Array{int64(user.ID)},
+	}
+	if sub.Digest == models.DigestWeekly {
+		event.Name = "Plan na nadchodzący tydzień"
+		event.NotificationMessage = fmt.Sprintf("W nadchodzącym tygodniu masz %d zajęć, pierwsze %s o %s.", len(classes), classes[0].Start.Format("02.01"), classes[0].Start.Format("15:04"))
+	} else {
+		event.Name = "Plan na dziś"
+		event.NotificationMessage = fmt.Sprintf("Dziś masz %d zajęć, pierwsze o %s: %s.", len(classes), classes[0].Start.Format("15:04"), classes[0].Class)
+	}
+	for _, class := range classes {
+		event.Description += class.String()
+		if len(class.Note) > 0 {
+			event.Description += " (" + class.Note + ")"
+		}
+		event.Description += "\n"
+	}
+	if raw, err := json.Marshal(classes); err == nil {
+		event.Payload = &models.EventPayload{Kind: models.EventPayloadTimetableDigest, Classes: raw}
+	}
+
+	// digests are stored so that links in messages lead to them, but they're only delivered through this subscription and aren't listed
+	if res := d.Database.Create(event); res.Error != nil {
+		return res.Error
+	}
+	return d.Channels.Deliver(sub, event)
+}
+
+// classes lists classes the user attends on the day of the time for daily digests,
+// or during the seven following days for weekly ones, cancelled classes are left out
+func (d *Digests) classes(kind models.DigestKind, user *models.User, at time.Time) ([]*timetable.Class, error) {
+	groups := user.AllGroups()
+	if len(groups) == 0 {
+		return nil, nil
+	}
+	tt, err := d.Timetable.LoadMerged(groups, timetable.DefaultPeriod)
+	if err != nil {
+		return nil, err
+	}
+	selections, err := models.UserClassSelections(d.Database, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	filter := &timetable.Filter{From: day, To: day.AddDate(0, 0, 1)}
+	if kind == models.DigestWeekly {
+		filter = &timetable.Filter{From: day.AddDate(0, 0, 1), To: day.AddDate(0, 0, 8)}
+	}
+	classes := []*timetable.Class{}
+	for _, class := range tt.Filter(filter).Classes {
+		if !class.Cancelled() && class.Attended(selections) {
+			classes = append(classes, class)
+		}
+	}
+	sort.SliceStable(classes, func(i, j int) bool {
+		return classes[i].Start.Before(classes[j].Start)
+	})
+	return classes, nil
+}
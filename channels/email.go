@@ -0,0 +1,105 @@
+package channels
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/mail"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
+)
+
+const (
+	// ChannelTypeEmail subscriptions hold the email address as the channel id
+	ChannelTypeEmail models.ChannelType = "email"
+)
+
+var ErrEmailNotOwned = errors.New("subscribed email is not the account's email")
+
+var emailTemplate = template.Must(template.New("event").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+<h2>{{.Event.Name}}</h2>
+{{if .Event.Image}}<p><img src="{{.Event.Image}}" alt="" style="max-width: 100%;"></p>{{end}}
+{{if .Changes}}
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr style="text-align: left;"><th>Zmiana</th><th>Przedmiot</th><th>Było</th><th>Jest</th></tr>
+{{range .Changes}}
+<tr style="border-top: 1px solid #ddd; vertical-align: top;">
+<td>{{.Label}}</td>
+<td>{{.Subject}}</td>
+<td>{{with .Old}}{{.Start.Format "02.01.2006 15:04"}}–{{.End.Format "15:04"}}<br>{{.Type}}, {{.Teacher}}<br>{{.Room}}{{else}}–{{end}}</td>
+<td>{{with .New}}{{.Start.Format "02.01.2006 15:04"}}–{{.End.Format "15:04"}}<br>{{.Type}}, {{.Teacher}}<br>{{.Room}}{{else}}–{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else if .Classes}}
+<table cellpadding="6" style="border-collapse: collapse;">
+<tr style="text-align: left;"><th>Termin</th><th>Przedmiot</th><th>Typ</th><th>Prowadzący</th><th>Sala</th></tr>
+{{range .Classes}}
+<tr style="border-top: 1px solid #ddd; vertical-align: top;">
+<td>{{.Start.Format "02.01.2006 15:04"}}–{{.End.Format "15:04"}}</td>
+<td>{{.Class}}{{if .Note}}<br><small>{{.Note}}</small>{{end}}</td>
+<td>{{.Type}}</td>
+<td>{{.Teacher}}</td>
+<td>{{.Room}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>{{.Event.Description}}</p>
+{{end}}
+<p><a href="{{.Link}}">Zobacz więcej</a></p>
+</body>
+</html>
+`))
+
+// Email delivers events through the mailer, timetable changes and digests are rendered as tables.
+// Mail is only sent while the subscribed address is still the account's email.
+type Email struct {
+	Mailer   mail.Mailer
+	Database *gorm.DB
+}
+
+func (e *Email) Type() models.ChannelType {
+	return ChannelTypeEmail
+}
+
+// Register does nothing, emails don't need callbacks
+func (e *Email) Register(router *mux.Router) {}
+
+func (e *Email) Send(sub *models.Subscription, event *models.Event) error {
+	owner := models.User{}
+	if res := e.Database.First(&owner, sub.UserID); res.Error != nil {
+		return res.Error
+	}
+	if !strings.EqualFold(strings.TrimSpace(sub.ChannelID), owner.Email) {
+		return ErrEmailNotOwned
+	}
+
+	data := struct {
+		Event   *models.Event
+		Changes timetable.TimetableDiff
+		Classes []*timetable.Class
+		Link    string
+	}{
+		Event: event,
+		Link:  fmt.Sprintf("https://uek.kochanow.ski/#/dashboard/events/%d/email/", event.ID),
+	}
+	if diff, ok := timetableChanges(event); ok {
+		data.Changes = diff
+	} else if classes, ok := digestClasses(event); ok {
+		data.Classes = classes
+	}
+
+	body := &bytes.Buffer{}
+	if err := emailTemplate.Execute(body, &data); err != nil {
+		return err
+	}
+	return e.Mailer.Send(sub.ChannelID, event.Name, body.String())
+}
@@ -12,10 +12,15 @@ import (
 	messenger "github.com/maciekmm/messenger-platform-go-sdk"
 	"github.com/maciekmm/messenger-platform-go-sdk/template"
 	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
 )
 
 const (
 	ChannelTypeMessenger models.ChannelType = "messenger"
+	// messengerCarouselLimit is the maximum number of elements of a generic template
+	messengerCarouselLimit  = 10
+	messengerTitleLength    = 45
+	messengerSubtitleLength = 80
 )
 
 type Messenger struct {
@@ -46,18 +51,89 @@ func (m *Messenger) Register(router *mux.Router) {
 func (m *Messenger) Send(sub *models.Subscription, event *models.Event) error {
 	mq := messenger.MessageQuery{}
 	mq.RecipientID(sub.ChannelID)
-	mq.Template(template.GenericTemplate{
-		Title:    event.Name,
-		ImageURL: event.Image,
-		Subtitle: event.NotificationMessage,
-		Buttons: []template.Button{
-			template.NewWebURLButton("Zobacz więcej", fmt.Sprintf("https://uek.kochanow.ski/#/dashboard/events/%d/messenger/", event.ID)),
-		},
-	})
+	link := fmt.Sprintf("https://uek.kochanow.ski/#/dashboard/events/%d/messenger/", event.ID)
+	if diff, ok := timetableChanges(event); ok {
+		for _, element := range changeCarousel(diff, link) {
+			mq.Template(element)
+		}
+	} else if classes, ok := digestClasses(event); ok {
+		for _, element := range classCarousel(event.Name, classes, link) {
+			mq.Template(element)
+		}
+	} else {
+		mq.Template(template.GenericTemplate{
+			Title:    event.Name,
+			ImageURL: event.Image,
+			Subtitle: event.NotificationMessage,
+			Buttons: []template.Button{
+				template.NewWebURLButton("Zobacz więcej", link),
+			},
+		})
+	}
 	_, err := m.messenger.SendMessage(mq)
 	return err
 }
 
+// classCarousel renders every class of a digest as an element of a carousel, classes which don't fit are summed up in the last element
+func classCarousel(title string, classes []*timetable.Class, link string) []template.GenericTemplate {
+	elements := []template.GenericTemplate{}
+	for i, class := range classes {
+		if i == messengerCarouselLimit-1 && len(classes) > messengerCarouselLimit {
+			elements = append(elements, template.GenericTemplate{
+				Title:    truncate(title, messengerTitleLength),
+				Subtitle: fmt.Sprintf("…i %d innych zajęć", len(classes)-i),
+				Buttons:  []template.Button{template.NewWebURLButton("Zobacz wszystkie", link)},
+			})
+			break
+		}
+		elements = append(elements, template.GenericTemplate{
+			Title:    truncate(class.Start.Format("15:04")+" "+class.Class, messengerTitleLength),
+			Subtitle: truncate(shortClassSummary(class), messengerSubtitleLength),
+			Buttons:  []template.Button{template.NewWebURLButton("Zobacz więcej", link)},
+		})
+	}
+	return elements
+}
+
+// shortClassSummary lists the day, type, room and notes of the class
+func shortClassSummary(class *timetable.Class) string {
+	summary := class.Start.Format("02.01") + ", " + class.Type + ", " + class.Room
+	if len(class.Note) > 0 {
+		summary += " (" + class.Note + ")"
+	}
+	return summary
+}
+
+// changeCarousel renders every change as an element of a carousel, changes which don't fit are summed up in the last element
+func changeCarousel(diff timetable.TimetableDiff, link string) []template.GenericTemplate {
+	elements := []template.GenericTemplate{}
+	for i, change := range diff {
+		if i == messengerCarouselLimit-1 && len(diff) > messengerCarouselLimit {
+			elements = append(elements, template.GenericTemplate{
+				Title:    "Zmiana w planie zajęć!",
+				Subtitle: fmt.Sprintf("…i %d innych zmian", len(diff)-i),
+				Buttons:  []template.Button{template.NewWebURLButton("Zobacz wszystkie", link)},
+			})
+			break
+		}
+		elements = append(elements, template.GenericTemplate{
+			Title:    truncate(change.Label()+": "+change.Subject(), messengerTitleLength),
+			Subtitle: truncate(change.Summary(), messengerSubtitleLength),
+			Buttons:  []template.Button{template.NewWebURLButton("Zobacz więcej", link)},
+		})
+	}
+	return elements
+}
+
+// truncate shortens the text to the number of characters, marking it with an ellipsis
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
+
 func (m *Messenger) AuthenticationHandler(event messenger.Event, opts messenger.MessageOpts, optin *messenger.Optin) {
 	if optin == nil {
 		return
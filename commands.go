@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const generatedAdminPasswordLength = 12
+
+var (
+	ErrCommandUnknown      = errors.New("unknown command")
+	ErrCommandEmailMissing = errors.New("email is required")
+)
+
+// runCommand executes a maintenance command instead of starting the server
+func (a *Application) runCommand(args []string) error {
+	switch args[0] {
+	case "create-admin":
+		return a.createAdmin(args[1:])
+	}
+	return fmt.Errorf("%s: %s", ErrCommandUnknown.Error(), args[0])
+}
+
+// createAdmin creates an admin account or promotes an existing one, it's meant for bootstrapping the first admin
+func (a *Application) createAdmin(args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := flags.String("email", "", "admin's email")
+	name := flags.String("name", "Admin", "admin's name")
+	password := flags.String("password", "", "admin's password, generated if empty")
+	group := flags.Uint("group", 0, "admin's group")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if len(*email) == 0 {
+		return ErrCommandEmailMissing
+	}
+
+	user := models.User{}
+	res := a.Database.First(&user, "email = ?", *email)
+	if res.Error != nil && !res.RecordNotFound() {
+		return fmt.Errorf("could not query the database: %s", res.Error.Error())
+	}
+
+	// existing accounts keep their password unless a new one is supplied
+	generated := false
+	if len(*password) == 0 && res.RecordNotFound() {
+		pwd, err := utils.RandomString(generatedAdminPasswordLength)
+		if err != nil {
+			return fmt.Errorf("could not generate password: %s", err.Error())
+		}
+		*password = pwd
+		generated = true
+	}
+
+	if len(*password) > 0 {
+		if !generated {
+			if err := models.ValidatePassword(*password); err != nil {
+				return err
+			}
+		}
+		if err := user.SetPassword(*password); err != nil {
+			return fmt.Errorf("could not encrypt admin's password: %s", err.Error())
+		}
+	}
+	user.Email = *email
+	user.Role = models.RoleAdmin
+	user.Deactivated = false
+	if len(user.Name) == 0 {
+		user.Name = *name
+	}
+	if *group != 0 {
+		grp := *group
+		user.Group = &grp
+	}
+
+	if res := a.Database.Save(&user); res.Error != nil {
+		return fmt.Errorf("could not save admin: %s", res.Error.Error())
+	}
+
+	a.Logger.Printf("admin %s (id: %d) is ready\n", user.Email, user.ID)
+	if generated {
+		fmt.Printf("generated password: %s\n", *password)
+	}
+	return nil
+}
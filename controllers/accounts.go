@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"os"
@@ -12,45 +15,107 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/mail"
 	"github.com/maciekmm/uek-bruschetta/middleware"
 	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/oidc"
+	"github.com/maciekmm/uek-bruschetta/timetable"
 	"github.com/maciekmm/uek-bruschetta/utils"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	ErrUserEmailInvalid     = errors.New("email invalid")
-	ErrUserPasswordInvalid  = errors.New("password invalid")
-	ErrUserNameInvalid      = errors.New("name invalid")
-	ErrUserEmailRegistered  = errors.New("mail already registered")
-	ErrUserEmailNotFound    = errors.New("email not found")
-	ErrUserGroupInvalid     = errors.New("group invalid")
-	ErrAccountsUnknown      = errors.New("unknown error occured")
-	ErrAccountsParsingError = errors.New("token parsing error occured")
+	ErrUserEmailInvalid           = errors.New("email invalid")
+	ErrUserPasswordInvalid        = errors.New("password invalid")
+	ErrUserNameInvalid            = errors.New("name invalid")
+	ErrUserEmailRegistered        = errors.New("mail already registered")
+	ErrUserEmailNotFound          = errors.New("email not found")
+	ErrUserGroupInvalid           = errors.New("group invalid")
+	ErrUserDeactivated            = errors.New("account deactivated")
+	ErrUserCurrentPasswordInvalid = errors.New("current password invalid")
+	ErrUserPasswordNotSet         = errors.New("the account has no password, set one first")
+	ErrUserCredentialsInvalid     = errors.New("invalid email or password")
+	ErrUserReminderInvalid        = errors.New("reminder lead time has to be between 0 and 1440 minutes")
+	ErrAccountsUnknown            = errors.New("unknown error occured")
+	ErrAccountsTooManyAttempts    = errors.New("too many attempts, try again later")
+	ErrAccountsParsingError       = errors.New("token parsing error occured")
 )
 
+type invitationRegistration struct {
+	Token    string `json:"token"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Group is only used if the invitation doesn't preset one
+	Group *uint `json:"group"`
+}
+
+// registrationResponse is returned whether or not the email was already registered, the outcome is only sent by mail
+type registrationResponse struct {
+	Status string `json:"status"`
+}
+
+const registrationReceived = "registration received, check your mailbox"
+
 type jwtResponse struct {
-	Token string `json:"token"`
+	Token string `json:"token,omitempty"`
+	// MFAToken is returned instead of Token if the login has to be finished with a second factor
+	MFARequired          bool   `json:"mfa_required,omitempty"`
+	MFAToken             string `json:"mfa_token,omitempty"`
+	MFAEnrolmentRequired bool   `json:"mfa_enrolment_required,omitempty"`
 }
 
+// dummyPasswordHash is compared against when the user doesn't exist, it's a hash of a random password
+var dummyPasswordHash = func() string {
+	pwd, _ := utils.RandomString(16)
+	user := models.User{}
+	user.SetPassword(pwd)
+	return user.Password
+}()
+
 type Accounts struct {
-	Database *gorm.DB
+	Database  *gorm.DB
+	Timetable *timetable.Coordinator
+	Mailer    mail.Mailer
+	// AccountThrottle limits failed logins per email, IPThrottle limits failed logins and registrations per client address
+	AccountThrottle *middleware.Throttle
+	IPThrottle      *middleware.Throttle
+	// OpenID enables logging in through an OpenID Connect provider if set
+	OpenID       *oidc.Provider
+	OpenIDLogins *oidc.PendingLogins
 }
 
 func (a *Accounts) Register(router *mux.Router) {
 	postRouter := router
 	postRouter.HandleFunc("/register/", a.HandleRegister).Methods(http.MethodPost)
+	postRouter.HandleFunc("/register/invitation/", a.HandleRegisterInvitation).Methods(http.MethodPost)
 	postRouter.HandleFunc("/login/", a.HandleLogin).Methods(http.MethodPost)
 	postRouter.HandleFunc("/token/", a.HandleRefresh).Methods(http.MethodPost)
+	a.registerProfile(router)
+	a.registerPrivacy(router)
+	a.registerTwoFactor(router)
+	a.registerOpenID(router)
+	a.registerSessions(router)
+}
+
+// issueToken starts a new session and generates its first token
+func (a *Accounts) issueToken(r *http.Request, user *models.User, mfa bool) (string, error) {
+	session, err := models.StartSession(a.Database, user.ID, r.UserAgent(), utils.ClientIP(r))
+	if err != nil {
+		return "", fmt.Errorf("could not start session: %s", err)
+	}
+	return a.generateJWT(user, mfa, session.Family)
 }
 
-func (a *Accounts) generateJWT(user *models.User) (string, error) {
+// generateJWT generates a token belonging to the session family
+func (a *Accounts) generateJWT(user *models.User, mfa bool, family string) (string, error) {
 	// generate JWT
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, middleware.AuthClaims{
 		StandardClaims: jwt.StandardClaims{
+			Id:        family,
 			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
 		},
 		User: user,
+		MFA:  mfa,
 	})
 	tok, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	if err != nil {
@@ -59,6 +124,25 @@ func (a *Accounts) generateJWT(user *models.User) (string, error) {
 	return tok, nil
 }
 
+// allowed writes an error response and returns false if the key is locked out by the throttle
+func (a *Accounts) allowed(rw http.ResponseWriter, throttle *middleware.Throttle, key string) bool {
+	if throttle == nil {
+		return true
+	}
+	if ok, wait := throttle.Allowed(key); !ok {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		utils.NewErrorResponse(ErrAccountsTooManyAttempts).Write(http.StatusTooManyRequests, rw)
+		return false
+	}
+	return true
+}
+
+func (a *Accounts) fail(throttle *middleware.Throttle, key string) {
+	if throttle != nil {
+		throttle.Fail(key)
+	}
+}
+
 func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 	// decode request
 	decoder := json.NewDecoder(r.Body)
@@ -79,6 +163,8 @@ func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 	}
 	if len(user.Password) == 0 {
 		errors = append(errors, ErrUserPasswordInvalid.Error())
+	} else if err := models.ValidatePassword(user.Password); err != nil {
+		errors = append(errors, err.Error())
 	}
 	if len(user.Name) == 0 {
 		errors = append(errors, ErrUserNameInvalid.Error())
@@ -97,20 +183,17 @@ func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 	if os.Getenv("DEBUG") != "TRUE" {
 		user.Role = models.RoleUser
 	}
+	user.Deactivated = false
 
-	// check if user already exists
-	var existingUser models.User
-
-	res := a.Database.First(&existingUser, "email = ?", user.Email)
-
-	if !res.RecordNotFound() {
-		utils.NewErrorResponse(ErrUserEmailRegistered).Write(http.StatusBadRequest, rw)
+	// every attempt counts, so that registered emails can't be probed by repeated registrations
+	ipKey := "register:" + utils.ClientIP(r)
+	if !a.allowed(rw, a.IPThrottle, ipKey) {
 		return
 	}
+	a.fail(a.IPThrottle, ipKey)
 
-	// encrypt password
-	pwd, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
+	// encrypt password, it's done before the lookup so that both outcomes take as long
+	if err := user.SetPassword(user.Password); err != nil {
 		(&utils.ErrorResponse{
 			Errors:      []string{ErrAccountsUnknown.Error()},
 			DebugErrors: []string{fmt.Sprintf("could not encrypt user's password: %s", err)},
@@ -118,7 +201,19 @@ func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.Password = string(pwd)
+	// check if user already exists
+	registered, err := a.emailRegistered(user.Email)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if registered {
+		a.finishRegistration(rw, user.Email, false)
+		return
+	}
 
 	if err := a.Database.Create(&user).Error; err != nil {
 		(&utils.ErrorResponse{
@@ -127,12 +222,104 @@ func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	a.finishRegistration(rw, user.Email, true)
+}
 
-	// clear the password for struct reuse
-	user.Password = ""
+// emailRegistered reports whether an account uses the email
+func (a *Accounts) emailRegistered(email string) (bool, error) {
+	var existingUser models.User
+	res := a.Database.First(&existingUser, "email = ?", email)
+	if res.RecordNotFound() {
+		return false, nil
+	}
+	return res.Error == nil, res.Error
+}
 
-	tok, err := a.generateJWT(&user)
+// finishRegistration mails the outcome of the registration to the address and responds the same way regardless of it.
+// Mailing errors aren't reported as they would reveal whether the address was registered.
+func (a *Accounts) finishRegistration(rw http.ResponseWriter, email string, created bool) {
+	if a.Mailer != nil {
+		if created {
+			a.Mailer.Send(email, "Witaj w Platformie UEK", "Twoje konto w Platformie UEK zostało założone, możesz się już zalogować.")
+		} else {
+			a.Mailer.Send(email, "Próba rejestracji w Platformie UEK", "Ktoś próbował założyć konto w Platformie UEK z tym adresem email, ale konto z tym adresem już istnieje. Możesz się na nie zalogować.\n\nJeśli to nie Ty, zignoruj tę wiadomość.")
+		}
+	}
+	body, _ := json.Marshal(&registrationResponse{Status: registrationReceived})
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// HandleRegisterInvitation creates an account with the role, group and moderated groups preset by the invitation
+func (a *Accounts) HandleRegisterInvitation(rw http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := invitationRegistration{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
 
+	errors := []error{}
+	if len(req.Token) == 0 {
+		errors = append(errors, models.ErrInvitationInvalid)
+	}
+	if !strings.Contains(req.Email, "@") {
+		errors = append(errors, ErrUserEmailInvalid)
+	}
+	if len(req.Password) == 0 {
+		errors = append(errors, ErrUserPasswordInvalid)
+	} else if err := models.ValidatePassword(req.Password); err != nil {
+		errors = append(errors, err)
+	}
+	if len(req.Name) == 0 {
+		errors = append(errors, ErrUserNameInvalid)
+	}
+	if len(errors) != 0 {
+		utils.NewErrorResponse(errors...).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	ipKey := "register:" + utils.ClientIP(r)
+	if !a.allowed(rw, a.IPThrottle, ipKey) {
+		return
+	}
+	a.fail(a.IPThrottle, ipKey)
+
+	invitation, err := models.FindInvitation(a.Database, req.Token)
+	if err == models.ErrInvitationInvalid {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	user := models.User{
+		Name:  req.Name,
+		Email: req.Email,
+		Group: req.Group,
+	}
+	if invitation.Group == nil && (user.Group == nil || (a.Timetable != nil && !a.Timetable.GroupExists(*user.Group))) {
+		utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if err := user.SetPassword(req.Password); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("could not encrypt user's password: %s", err)},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	registered, err := a.emailRegistered(user.Email)
 	if err != nil {
 		(&utils.ErrorResponse{
 			Errors:      []string{ErrAccountsUnknown.Error()},
@@ -140,13 +327,23 @@ func (a *Accounts) HandleRegister(rw http.ResponseWriter, r *http.Request) {
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if registered {
+		a.finishRegistration(rw, user.Email, false)
+		return
+	}
 
-	// return JWT to client
-	body, _ := json.Marshal(&jwtResponse{
-		Token: tok,
-	})
-	rw.WriteHeader(http.StatusOK)
-	rw.Write(body)
+	if err := invitation.Redeem(a.Database, &user); err == models.ErrInvitationInvalid || err == models.ErrInvitationEmailMismatch {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	a.finishRegistration(rw, user.Email, true)
 }
 
 func (a *Accounts) HandleLogin(rw http.ResponseWriter, r *http.Request) {
@@ -177,15 +374,15 @@ func (a *Accounts) HandleLogin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var dbUser models.User
-	res := a.Database.First(&dbUser, "email = ?", user.Email)
-
-	if res.RecordNotFound() {
-		utils.NewErrorResponse(ErrUserEmailNotFound).Write(http.StatusBadRequest, rw)
+	ipKey, accountKey := "ip:"+utils.ClientIP(r), "account:"+strings.ToLower(user.Email)
+	if !a.allowed(rw, a.IPThrottle, ipKey) || !a.allowed(rw, a.AccountThrottle, accountKey) {
 		return
 	}
 
-	if res.Error != nil {
+	var dbUser models.User
+	res := a.Database.First(&dbUser, "email = ?", user.Email)
+
+	if res.Error != nil && !res.RecordNotFound() {
 		(&utils.ErrorResponse{
 			Errors:      []string{ErrAccountsUnknown.Error()},
 			DebugErrors: []string{fmt.Sprintf("error occured while querying the database: %s", res.Error.Error())},
@@ -193,28 +390,34 @@ func (a *Accounts) HandleLogin(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(dbUser.Password), []byte(user.Password)); err != nil {
-		utils.NewErrorResponse(ErrUserPasswordInvalid).Write(http.StatusBadRequest, rw)
+	// unknown emails are checked against a dummy hash, so that both cases take the same time and return the same error
+	if res.RecordNotFound() {
+		dbUser.Password = dummyPasswordHash
+	}
+	if !dbUser.CheckPassword(user.Password) || res.RecordNotFound() {
+		a.fail(a.IPThrottle, ipKey)
+		a.fail(a.AccountThrottle, accountKey)
+		utils.NewErrorResponse(ErrUserCredentialsInvalid).Write(http.StatusBadRequest, rw)
 		return
 	}
+	if a.AccountThrottle != nil {
+		a.AccountThrottle.Succeed(accountKey)
+	}
 
-	dbUser.Password = ""
-
-	// generate JWT
-	tok, err := a.generateJWT(&dbUser)
-	if err != nil {
-		(&utils.ErrorResponse{
-			Errors: []string{err.Error()},
-		}).Write(http.StatusInternalServerError, rw)
+	if dbUser.Deactivated {
+		utils.NewErrorResponse(ErrUserDeactivated).Write(http.StatusForbidden, rw)
 		return
 	}
 
-	// return JWT to client
-	body, _ := json.Marshal(&jwtResponse{
-		Token: tok,
-	})
-	rw.WriteHeader(http.StatusOK)
-	rw.Write(body)
+	// hashes made with a different cost are upgraded while the plain password is at hand, the login doesn't depend on it
+	if dbUser.PasswordNeedsRehash() {
+		if err := dbUser.SetPassword(user.Password); err == nil {
+			a.Database.Model(&dbUser).UpdateColumn("password", dbUser.Password)
+		}
+	}
+
+	dbUser.Password = ""
+	a.completeLogin(rw, r, &dbUser)
 }
 
 func (a *Accounts) HandleRefresh(rw http.ResponseWriter, r *http.Request) {
@@ -235,6 +438,11 @@ func (a *Accounts) HandleRefresh(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if claims.Impersonator != 0 {
+		utils.NewErrorResponse(middleware.ErrAuthReadOnly).Write(http.StatusForbidden, rw)
+		return
+	}
+
 	user := models.User{}
 	if res := a.Database.First(&user, claims.User.ID); res.Error != nil {
 		(&utils.ErrorResponse{
@@ -244,8 +452,28 @@ func (a *Accounts) HandleRefresh(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Deactivated {
+		utils.NewErrorResponse(ErrUserDeactivated).Write(http.StatusForbidden, rw)
+		return
+	}
+	user.Password = ""
+
+	// refreshed tokens stay in the family, so revoking the session revokes them as well
+	session, err := models.FindSession(a.Database, claims.Id)
+	if err == models.ErrSessionNotFound || (err == nil && session.UserID != user.ID) {
+		utils.NewErrorResponse(middleware.ErrAuthSessionRevoked).Write(http.StatusUnauthorized, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	session.Touch(a.Database, utils.ClientIP(r))
+
 	// generate JWT
-	token, err := a.generateJWT(&user)
+	token, err := a.generateJWT(&user, claims.MFA, session.Family)
 	if err != nil {
 		(&utils.ErrorResponse{
 			Errors: []string{err.Error()},
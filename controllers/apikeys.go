@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+type apiKeyResponse struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+// APIKeys lets admins manage keys used by external services
+type APIKeys struct {
+	Database *gorm.DB
+}
+
+func (k *APIKeys) Register(router *mux.Router) {
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(k.HandleGetAll))).Methods(http.MethodGet)
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(k.HandleAdd))).Methods(http.MethodPost)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(k.HandleDelete))).Methods(http.MethodDelete)
+}
+
+func (k *APIKeys) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
+	keys := []models.APIKey{}
+	if res := k.Database.Order("id").Find(&keys); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&keys)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleAdd creates a key acting on behalf of the requesting admin, the key is only returned in this response
+func (k *APIKeys) HandleAdd(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	key := models.APIKey{}
+	if err := decoder.Decode(&key); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+	key.ID = 0
+	key.UserID = user.ID
+
+	tx := beginAudited(rw, k.Database)
+	if tx == nil {
+		return
+	}
+	raw, err := key.Add(tx)
+	if err != nil {
+		tx.Rollback()
+		if res, ok := err.(*utils.ErrorResponse); ok {
+			res.Write(http.StatusBadRequest, rw)
+			return
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if !audit(rw, r, tx, models.AuditAPIKeyCreate, "apikey", key.ID, nil, &key) {
+		return
+	}
+
+	byt, err := json.Marshal(&apiKeyResponse{APIKey: key, Key: raw})
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleDelete revokes the key
+func (k *APIKeys) HandleDelete(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeyIDInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	tx := beginAudited(rw, k.Database)
+	if tx == nil {
+		return
+	}
+	res := tx.Delete(&models.APIKey{Model: gorm.Model{ID: uint(id)}})
+	if res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		utils.NewErrorResponse(models.ErrAPIKeyNotFound).Write(http.StatusNotFound, rw)
+		return
+	}
+	if !audit(rw, r, tx, models.AuditAPIKeyRevoke, "apikey", uint(id), nil, nil) {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaximumLimit = 1000
+)
+
+// Audit lets admins browse the audit log, there's deliberately no way to change it
+type Audit struct {
+	Database *gorm.DB
+}
+
+func (a *Audit) Register(router *mux.Router) {
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(a.HandleGetAll))).Methods(http.MethodGet)
+}
+
+// HandleGetAll lists entries newest first, filtered by actor, action, target and time range
+func (a *Audit) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	res := a.Database.Order("id DESC")
+
+	if actor, err := strconv.Atoi(query.Get("actor")); err == nil {
+		res = res.Where("actor_id = ?", actor)
+	}
+	if action := query.Get("action"); len(action) > 0 {
+		res = res.Where("action = ?", action)
+	}
+	if targetType := query.Get("target_type"); len(targetType) > 0 {
+		res = res.Where("target_type = ?", targetType)
+	}
+	if target, err := strconv.Atoi(query.Get("target_id")); err == nil {
+		res = res.Where("target_id = ?", target)
+	}
+	if since, err := time.Parse(time.RFC3339, query.Get("since")); err == nil {
+		res = res.Where("created_at >= ?", since)
+	}
+	if until, err := time.Parse(time.RFC3339, query.Get("until")); err == nil {
+		res = res.Where("created_at < ?", until)
+	}
+
+	limit := auditDefaultLimit
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= auditMaximumLimit {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	entries := []models.AuditEntry{}
+	if res := res.Limit(limit).Offset(offset).Find(&entries); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAuditUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&entries)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAuditUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// beginAudited starts the transaction of an action recorded in the audit log, the action and its entry are committed together by audit.
+// It writes an error response and returns nil if the transaction couldn't be started.
+func beginAudited(rw http.ResponseWriter, db *gorm.DB) *gorm.DB {
+	tx := db.Begin()
+	if tx.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAuditFailed.Error()},
+			DebugErrors: []string{tx.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	return tx
+}
+
+// audit records an action of the requesting user in the transaction started by beginAudited and commits it, snapshots are optional.
+// It rolls the action back, writes an error response and returns false if the entry couldn't be stored.
+func audit(rw http.ResponseWriter, r *http.Request, tx *gorm.DB, action models.AuditAction, targetType string, targetID uint, before, after interface{}) bool {
+	entry := &models.AuditEntry{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         utils.ClientIP(r),
+	}
+	if user, ok := r.Context().Value(middleware.ContextUserKey).(*models.User); ok {
+		entry.ActorID = user.ID
+	}
+	if key, ok := r.Context().Value(middleware.ContextAPIKeyKey).(*models.APIKey); ok {
+		entry.APIKeyID = &key.ID
+	}
+
+	err := entry.Add(tx, before, after)
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAuditFailed.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return false
+	}
+	return true
+}
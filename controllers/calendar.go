@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+// Calendar serves timetables and dated events as iCalendar feeds.
+// Group feeds are public like timetables, personal feeds are authorized by a secret token in the url so calendar apps can subscribe to them.
+type Calendar struct {
+	Database  *gorm.DB
+	Timetable *timetable.Coordinator
+}
+
+type feedTokenResponse struct {
+	*models.FeedToken
+	Token     string `json:"token,omitempty"`
+	URL       string `json:"url,omitempty"`
+	WebcalURL string `json:"webcal_url,omitempty"`
+}
+
+func (c *Calendar) Register(router *mux.Router) {
+	router.HandleFunc("/groups/{group:[0-9]+}.ics", c.HandleGetGroup).Methods(http.MethodGet)
+	router.HandleFunc("/feed/{token}.ics", c.HandleGetFeed).Methods(http.MethodGet)
+	router.Handle("/token/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleGetToken))).Methods(http.MethodGet)
+	router.Handle("/token/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleIssueToken))).Methods(http.MethodPost)
+	router.Handle("/token/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleRevokeToken))).Methods(http.MethodDelete)
+}
+
+// HandleGetGroup serves classes of the group along with dated events addressed to everyone.
+// It's not authenticated, so events of the group are only served through personal feeds.
+func (c *Calendar) HandleGetGroup(rw http.ResponseWriter, r *http.Request) {
+	group, err := strconv.Atoi(mux.Vars(r)["group"])
+	if err != nil || c.Timetable == nil || !c.Timetable.GroupExists(uint(group)) {
+		utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusNotFound, rw)
+		return
+	}
+	c.writeCalendar(rw, r, []uint{uint(group)}, nil, 0)
+}
+
+// HandleGetFeed serves classes of all the user's groups along with events visible to the user
+func (c *Calendar) HandleGetFeed(rw http.ResponseWriter, r *http.Request) {
+	user, err := models.FindFeedUser(c.Database, mux.Vars(r)["token"])
+	if err == models.ErrFeedTokenInvalid {
+		utils.NewErrorResponse(err).Write(http.StatusNotFound, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	groups, err := visibleGroups(c.Database, user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	c.writeCalendar(rw, r, user.AllGroups(), groups, user.ID)
+}
+
+// writeCalendar serves classes of classGroups and events visible to the user, anonymous callers pass 0 as the user
+func (c *Calendar) writeCalendar(rw http.ResponseWriter, r *http.Request, classGroups []uint, eventGroups []uint, userID uint) {
+	period := timetable.DefaultPeriod
+	if p, err := strconv.Atoi(r.URL.Query().Get("period")); err == nil && p > 0 {
+		period = uint(p)
+	}
+
+	calendar := &timetable.Calendar{Events: []timetable.CalendarEvent{}}
+	if len(classGroups) > 0 && c.Timetable != nil {
+		tt, err := c.Timetable.LoadMerged(classGroups, period)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrFeedsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		calendar.Name = tt.Group
+		calendar.Events = append(calendar.Events, tt.CalendarEvents()...)
+	}
+	if len(calendar.Name) == 0 {
+		calendar.Name = "UEK"
+	}
+
+	events := []models.Event{}
+	if res := visibleEvents(c.Database, eventGroups, userID).Where("starts_at IS NOT NULL").Order("starts_at").Find(&events); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	for _, event := range events {
+		entry := timetable.CalendarEvent{
+			UID:         fmt.Sprintf("event-%d@uek-bruschetta", event.ID),
+			Start:       *event.StartsAt,
+			Summary:     event.Name,
+			Location:    event.Location,
+			Description: event.Description,
+			Modified:    event.UpdatedAt,
+		}
+		if event.EndsAt != nil {
+			entry.End = *event.EndsAt
+		}
+		calendar.Events = append(calendar.Events, entry)
+	}
+
+	rw.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	rw.Header().Set("Content-Disposition", "inline; filename=\"calendar.ics\"")
+	rw.WriteHeader(http.StatusOK)
+	calendar.WriteTo(rw)
+}
+
+// HandleGetToken shows when the feed token was issued and last used, the token itself can't be retrieved
+func (c *Calendar) HandleGetToken(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	feed, err := models.UserFeedToken(c.Database, user.ID)
+	if err == models.ErrFeedTokenMissing {
+		utils.NewErrorResponse(err).Write(http.StatusNotFound, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	c.writeToken(rw, &feedTokenResponse{FeedToken: feed})
+}
+
+// HandleIssueToken issues a new feed token, the previous one stops working
+func (c *Calendar) HandleIssueToken(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	feed, token, err := models.IssueFeedToken(c.Database, user.ID)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	url := fmt.Sprintf("%s/calendar/feed/%s.ics", strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"), token)
+	resp := &feedTokenResponse{FeedToken: feed, Token: token, URL: url}
+	if i := strings.Index(url, "://"); i >= 0 {
+		resp.WebcalURL = "webcal" + url[i:]
+	}
+	c.writeToken(rw, resp)
+}
+
+// HandleRevokeToken revokes the feed token
+func (c *Calendar) HandleRevokeToken(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	if err := models.RevokeFeedToken(c.Database, user.ID); err == models.ErrFeedTokenMissing {
+		utils.NewErrorResponse(err).Write(http.StatusNotFound, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (c *Calendar) writeToken(rw http.ResponseWriter, resp *feedTokenResponse) {
+	byt, err := json.Marshal(resp)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrFeedsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
@@ -20,13 +20,13 @@ type Events struct {
 }
 
 func (e *Events) Register(router *mux.Router) {
-	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(e.HandleAdd))).Methods(http.MethodPost)
-	router.Handle("/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(e.HandleGetAll))).Methods(http.MethodGet)
-	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(e.HandleGetSingle))).Methods(http.MethodGet)
-	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(e.HandlePatchSingle))).Methods(http.MethodPatch)
-	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(e.HandlePutSingle))).Methods(http.MethodPut)
-	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(e.HandleDelete))).Methods(http.MethodDelete)
-	router.Handle("/{id:[0-9]+}/interactions/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(e.HandleGetInteractions))).Methods(http.MethodGet)
+	router.Handle("/", middleware.RequiresModerator(http.HandlerFunc(e.HandleAdd), models.ScopeEventsWrite)).Methods(http.MethodPost)
+	router.Handle("/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(e.HandleGetAll), models.ScopeEventsRead)).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(e.HandleGetSingle), models.ScopeEventsRead)).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresModerator(http.HandlerFunc(e.HandlePatchSingle), models.ScopeEventsWrite)).Methods(http.MethodPatch)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresModerator(http.HandlerFunc(e.HandlePutSingle), models.ScopeEventsWrite)).Methods(http.MethodPut)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresModerator(http.HandlerFunc(e.HandleDelete), models.ScopeEventsWrite)).Methods(http.MethodDelete)
+	router.Handle("/{id:[0-9]+}/interactions/", middleware.RequiresModerator(http.HandlerFunc(e.HandleGetInteractions), models.ScopeAnalyticsRead)).Methods(http.MethodGet)
 }
 
 func (s *Events) HandleAdd(rw http.ResponseWriter, r *http.Request) {
@@ -42,9 +42,22 @@ func (s *Events) HandleAdd(rw http.ResponseWriter, r *http.Request) {
 		}).Write(http.StatusBadRequest, rw)
 		return
 	}
+	event.ID = 0
 	event.UserID = user.ID
+	event.Payload = nil
 
-	if err := event.Add(s.Database, s.Coordinator); err != nil {
+	perms := r.Context().Value(middleware.ContextPermissionsKey).(*models.Permissions)
+	if !perms.CanManage(event.Group) {
+		utils.NewErrorResponse(models.ErrPermissionDenied).Write(http.StatusForbidden, rw)
+		return
+	}
+
+	tx := beginAudited(rw, s.Database)
+	if tx == nil {
+		return
+	}
+	if err := event.Store(tx); err != nil {
+		tx.Rollback()
 		if res, ok := err.(*utils.ErrorResponse); ok {
 			res.Write(http.StatusBadRequest, rw)
 			return
@@ -56,6 +69,21 @@ func (s *Events) HandleAdd(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !audit(rw, r, tx, models.AuditEventCreate, "event", event.ID, nil, &event) {
+		return
+	}
+	// notifications are only sent once the event is committed
+	if err := event.Notify(s.Coordinator); err != nil {
+		if res, ok := err.(*utils.ErrorResponse); ok {
+			res.Write(http.StatusBadRequest, rw)
+			return
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrEventsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
@@ -71,22 +99,43 @@ func (s *Events) HandleDelete(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if res := s.Database.Delete(&models.Event{Model: gorm.Model{ID: uint(id)}}); res.Error != nil {
+	existing := s.managedEvent(rw, r, uint(id))
+	if existing == nil {
+		return
+	}
+
+	tx := beginAudited(rw, s.Database)
+	if tx == nil {
+		return
+	}
+	if res := tx.Delete(&models.Event{Model: gorm.Model{ID: uint(id)}}); res.Error != nil {
+		tx.Rollback()
 		(&utils.ErrorResponse{
 			Errors:      []string{models.ErrEventsUnknown.Error()},
 			DebugErrors: []string{res.Error.Error()},
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if !audit(rw, r, tx, models.AuditEventDelete, "event", existing.ID, existing, nil) {
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
 func (s *Events) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
 	events := []models.Event{}
-	res := s.Database
+	res := listedEvents(s.Database)
 	if user.Role != models.RoleAdmin {
-		res = res.Where("\"group\" = ? OR \"group\" IS NULL", *user.Group)
+		groups, err := visibleGroups(s.Database, user)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrEventsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		res = visibleEvents(res, groups, user.ID)
 	}
 	if res := res.Find(&events); res.Error != nil {
 		(&utils.ErrorResponse{
@@ -135,16 +184,28 @@ func (s *Events) HandleGetSingle(rw http.ResponseWriter, r *http.Request) {
 		interaction.Channel = &ch
 	}
 
-	// save user interaction
-	go func(db *gorm.DB, interaction *models.Interaction) {
-		// this is just for statistics purposes, we don't care if it fails
-		db.Create(interaction)
-	}(s.Database, interaction)
+	// save user interaction, services reading events through api keys and admins impersonating the user are not counted
+	_, viaKey := r.Context().Value(middleware.ContextAPIKeyKey).(*models.APIKey)
+	_, impersonated := r.Context().Value(middleware.ContextImpersonatorKey).(uint)
+	if !viaKey && !impersonated {
+		go func(db *gorm.DB, interaction *models.Interaction) {
+			// this is just for statistics purposes, we don't care if it fails
+			db.Create(interaction)
+		}(s.Database, interaction)
+	}
 
 	event := models.Event{}
 	res := s.Database
 	if user.Role != models.RoleAdmin {
-		res = res.Where("\"group\" = ? OR \"group\" IS NULL", *user.Group)
+		groups, err := visibleGroups(s.Database, user)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrEventsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		res = visibleEvents(res, groups, user.ID)
 	}
 	if res := res.First(&event, uint(id)); res.Error != nil {
 		(&utils.ErrorResponse{
@@ -191,11 +252,39 @@ func (s *Events) HandlePatchSingle(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	existing := s.managedEvent(rw, r, uint(id))
+	if existing == nil {
+		return
+	}
+	perms := r.Context().Value(middleware.ContextPermissionsKey).(*models.Permissions)
+	if event.Group != nil && !perms.CanManage(event.Group) {
+		utils.NewErrorResponse(models.ErrPermissionDenied).Write(http.StatusForbidden, rw)
+		return
+	}
+	// dates are checked against the stored ones they are patched over
+	dates := *existing
+	if event.StartsAt != nil {
+		dates.StartsAt = event.StartsAt
+	}
+	if event.EndsAt != nil {
+		dates.EndsAt = event.EndsAt
+	}
+	if !dates.DatesValid() {
+		utils.NewErrorResponse(models.ErrEventDatesInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
 	event.UserID = user.ID
+	event.Payload = nil
 	model := models.Event{}
 	model.ID = uint(id)
 
-	if res := s.Database.Model(&model).Updates(&event); res.Error != nil {
+	tx := beginAudited(rw, s.Database)
+	if tx == nil {
+		return
+	}
+	if res := tx.Model(&model).Updates(&event); res.Error != nil {
+		tx.Rollback()
 		(&utils.ErrorResponse{
 			Errors:      []string{models.ErrEventsUnknown.Error()},
 			DebugErrors: []string{res.Error.Error()},
@@ -203,6 +292,18 @@ func (s *Events) HandlePatchSingle(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	updated := models.Event{}
+	if res := tx.First(&updated, uint(id)); res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrEventsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !audit(rw, r, tx, models.AuditEventUpdate, "event", existing.ID, existing, &updated) {
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
@@ -231,15 +332,41 @@ func (s *Events) HandlePutSingle(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	existing := s.managedEvent(rw, r, uint(id))
+	if existing == nil {
+		return
+	}
+	perms := r.Context().Value(middleware.ContextPermissionsKey).(*models.Permissions)
+	if !perms.CanManage(event.Group) {
+		utils.NewErrorResponse(models.ErrPermissionDenied).Write(http.StatusForbidden, rw)
+		return
+	}
+
+	if !event.DatesValid() {
+		utils.NewErrorResponse(models.ErrEventDatesInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
 	event.ID = uint(id)
+	event.CreatedAt = existing.CreatedAt
 	event.UserID = user.ID
-	if res := s.Database.Save(&event); res.Error != nil {
+	event.Payload = existing.Payload
+	event.Users = existing.Users
+	tx := beginAudited(rw, s.Database)
+	if tx == nil {
+		return
+	}
+	if res := tx.Save(&event); res.Error != nil {
+		tx.Rollback()
 		(&utils.ErrorResponse{
 			Errors:      []string{models.ErrEventsUnknown.Error()},
 			DebugErrors: []string{res.Error.Error()},
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if !audit(rw, r, tx, models.AuditEventReplace, "event", existing.ID, existing, &event) {
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
@@ -253,6 +380,9 @@ func (e *Events) HandleGetInteractions(rw http.ResponseWriter, r *http.Request)
 		}).Write(http.StatusBadRequest, rw)
 		return
 	}
+	if e.managedEvent(rw, r, uint(id)) == nil {
+		return
+	}
 	interactions := []models.Interaction{}
 
 	e.Database.Where("event_id = ?", id).Find(&interactions)
@@ -268,3 +398,53 @@ func (e *Events) HandleGetInteractions(rw http.ResponseWriter, r *http.Request)
 	rw.WriteHeader(http.StatusOK)
 	rw.Write(byt)
 }
+
+// managedEvent loads the event and checks whether the requesting user manages its group.
+// It writes an error response and returns nil otherwise.
+func (e *Events) managedEvent(rw http.ResponseWriter, r *http.Request, id uint) *models.Event {
+	event := &models.Event{}
+	if res := e.Database.First(event, id); res.RecordNotFound() {
+		utils.NewErrorResponse(models.ErrEventNotFound).Write(http.StatusNotFound, rw)
+		return nil
+	} else if res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrEventsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+
+	perms := r.Context().Value(middleware.ContextPermissionsKey).(*models.Permissions)
+	if !perms.CanManage(event.Group) {
+		utils.NewErrorResponse(models.ErrPermissionDenied).Write(http.StatusForbidden, rw)
+		return nil
+	}
+	return event
+}
+
+// visibleGroups lists groups the user belongs to or moderates
+func visibleGroups(db *gorm.DB, user *models.User) ([]uint, error) {
+	if err := user.LoadGroups(db); err != nil {
+		return nil, err
+	}
+	perms, err := models.LoadPermissions(db, user)
+	if err != nil {
+		return nil, err
+	}
+	return append(user.AllGroups(), perms.ModeratedGroups()...), nil
+}
+
+// listedEvents leaves out events of unlisted payload kinds, they are only reachable by their id
+func listedEvents(db *gorm.DB) *gorm.DB {
+	return db.Where("payload IS NULL OR payload->>'kind' NOT IN (?)", models.UnlistedEventPayloads)
+}
+
+// visibleEvents limits the query to global events and events targeting the groups,
+// events narrowed down to some members are only visible to them
+func visibleEvents(db *gorm.DB, groups []uint, userID uint) *gorm.DB {
+	db = db.Where("coalesce(array_length(\"users\", 1), 0) = 0 OR ? = ANY(\"users\")", userID)
+	if len(groups) == 0 {
+		return db.Where("\"group\" IS NULL")
+	}
+	return db.Where("\"group\" IN (?) OR \"group\" IS NULL", groups)
+}
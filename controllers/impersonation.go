@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const impersonationLifetime = 15 * time.Minute
+
+var ErrImpersonationNotAllowed = errors.New("only active non-admin users can be impersonated")
+
+type impersonationRequest struct {
+	Reason string `json:"reason"`
+}
+
+type impersonationResponse struct {
+	Token         string       `json:"token"`
+	ExpiresAt     time.Time    `json:"expires_at"`
+	Impersonating *models.User `json:"impersonating"`
+}
+
+// HandleImpersonate issues a short-lived read-only token acting as the user, so that admins can see what the user sees.
+// The token belongs to the admin's session and every impersonation is recorded in the audit log.
+func (u *Users) HandleImpersonate(rw http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	session, ok := r.Context().Value(middleware.ContextSessionKey).(*models.Session)
+	if !ok {
+		utils.NewErrorResponse(middleware.ErrAuthSessionRevoked).Write(http.StatusUnauthorized, rw)
+		return
+	}
+
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+	if user.Role >= models.RoleAdmin || user.Deactivated || user.ID == admin.ID {
+		utils.NewErrorResponse(ErrImpersonationNotAllowed).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := impersonationRequest{}
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// no token is issued unless the impersonation is recorded
+	entry := &models.AuditEntry{
+		ActorID:    admin.ID,
+		IP:         utils.ClientIP(r),
+		Action:     models.AuditImpersonationStarted,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Details:    req.Reason,
+	}
+	if err := entry.Add(u.Database, nil, nil); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrAuditUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	expiresAt := time.Now().Add(impersonationLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, middleware.AuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.Family,
+			ExpiresAt: expiresAt.Unix(),
+		},
+		User:         user,
+		Impersonator: admin.ID,
+	})
+	tok, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("error occured while generating JWT: %s", err)},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&impersonationResponse{
+		Token:         tok,
+		ExpiresAt:     expiresAt,
+		Impersonating: user,
+	})
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
@@ -0,0 +1,363 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	importMaximumSize = 1 << 20
+	importMaximumRows = 2000
+)
+
+const (
+	importModePending = "pending"
+	importModeInvite  = "invite"
+
+	importExistingSkip  = "skip"
+	importExistingMerge = "merge"
+)
+
+const (
+	importStatusCreated = "created"
+	importStatusInvited = "invited"
+	importStatusMerged  = "merged"
+	importStatusSkipped = "skipped"
+	importStatusFailed  = "failed"
+)
+
+var (
+	ErrImportModeInvalid     = errors.New("mode has to be either pending or invite")
+	ErrImportExistingInvalid = errors.New("existing has to be either skip or merge")
+	ErrImportFileInvalid     = errors.New("could not read csv file")
+	ErrImportTooManyRows     = errors.New("too many rows")
+	ErrImportColumnsInvalid  = errors.New("expected name, email and group columns")
+	ErrImportDuplicateEmail  = errors.New("email appears more than once in the file")
+	ErrImportMailFailed      = errors.New("could not send the invitation")
+)
+
+type importRow struct {
+	Line   int      `json:"line"`
+	Name   string   `json:"name"`
+	Email  string   `json:"email"`
+	Group  *uint    `json:"group,omitempty"`
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+	// DebugErrors follow the same rules as in utils.ErrorResponse
+	DebugErrors []string `json:"debug_errors,omitempty"`
+
+	// invitation and token of invited rows are kept until the import is committed and the invitation is mailed
+	invitation *models.Invitation
+	token      string
+}
+
+type importReport struct {
+	DryRun  bool        `json:"dry_run"`
+	Created int         `json:"created"`
+	Invited int         `json:"invited"`
+	Merged  int         `json:"merged"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Rows    []importRow `json:"rows"`
+}
+
+// HandleImport creates accounts from a CSV roster with name, email and group columns.
+// New users either get an account without a password (mode=pending) or an invitation email (mode=invite),
+// existing emails are skipped or have their name and group updated (existing=merge). Nothing is stored with dry_run=true.
+func (u *Users) HandleImport(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if len(mode) == 0 {
+		mode = importModePending
+	}
+	existing := query.Get("existing")
+	if len(existing) == 0 {
+		existing = importExistingSkip
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	errs := []error{}
+	if mode != importModePending && mode != importModeInvite {
+		errs = append(errs, ErrImportModeInvalid)
+	}
+	if existing != importExistingSkip && existing != importExistingMerge {
+		errs = append(errs, ErrImportExistingInvalid)
+	}
+	if len(errs) > 0 {
+		utils.NewErrorResponse(errs...).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	records, err := readRoster(rw, r)
+	if err != nil {
+		if res, ok := err.(*utils.ErrorResponse); ok {
+			res.Write(http.StatusBadRequest, rw)
+			return
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrImportFileInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// the header is optional
+	line := 1
+	if len(records) > 0 && len(records[0]) > 1 && strings.EqualFold(strings.TrimSpace(records[0][1]), "email") {
+		records = records[1:]
+		line++
+	}
+
+	db := u.Database
+	if !dryRun {
+		if db = beginAudited(rw, u.Database); db == nil {
+			return
+		}
+	}
+	report := importReport{DryRun: dryRun, Rows: []importRow{}}
+	seen := map[string]bool{}
+	for i, record := range records {
+		row := u.importRow(db, record, line+i, mode, existing, dryRun, seen)
+		switch row.Status {
+		case importStatusCreated:
+			report.Created++
+		case importStatusInvited:
+			report.Invited++
+		case importStatusMerged:
+			report.Merged++
+		case importStatusSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	if !dryRun && !audit(rw, r, db, models.AuditUserImport, "user", 0, nil, &report) {
+		return
+	}
+	if !dryRun {
+		u.mailInvitations(&report)
+	}
+
+	byt, err := json.Marshal(&report)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// readRoster reads CSV records either from the request body or from the file field of a multipart form.
+// Spreadsheets exported with Polish locale use semicolons, so they are accepted as well.
+func readRoster(rw http.ResponseWriter, r *http.Request) ([][]string, error) {
+	r.Body = http.MaxBytesReader(rw, r.Body, importMaximumSize)
+	defer r.Body.Close()
+
+	var reader io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	byt, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// strip UTF-8 BOM added by spreadsheet software
+	byt = bytes.TrimPrefix(byt, []byte("\xef\xbb\xbf"))
+
+	csvReader := csv.NewReader(bytes.NewReader(byt))
+	firstLine := strings.SplitN(string(byt), "\n", 2)[0]
+	if strings.Contains(firstLine, ";") && !strings.Contains(firstLine, ",") {
+		csvReader.Comma = ';'
+	}
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > importMaximumRows+1 {
+		return nil, utils.NewErrorResponse(ErrImportTooManyRows)
+	}
+	return records, nil
+}
+
+// importRow applies a single CSV record, outside of dry runs each row is applied within a savepoint
+// so that a failed row doesn't abort the import's transaction
+func (u *Users) importRow(db *gorm.DB, record []string, line int, mode, existing string, dryRun bool, seen map[string]bool) importRow {
+	if dryRun {
+		return u.importRecord(db, record, line, mode, existing, dryRun, seen)
+	}
+	if res := db.Exec("SAVEPOINT import_row"); res.Error != nil {
+		return failedRow(importRow{Line: line}, res.Error)
+	}
+	row := u.importRecord(db, record, line, mode, existing, dryRun, seen)
+	if row.Status == importStatusFailed {
+		db.Exec("ROLLBACK TO SAVEPOINT import_row")
+	} else {
+		db.Exec("RELEASE SAVEPOINT import_row")
+	}
+	return row
+}
+
+// importRecord validates and applies a single CSV record
+func (u *Users) importRecord(db *gorm.DB, record []string, line int, mode, existing string, dryRun bool, seen map[string]bool) importRow {
+	row := importRow{Line: line}
+	if len(record) != 3 {
+		row.Status = importStatusFailed
+		row.Errors = []string{ErrImportColumnsInvalid.Error()}
+		return row
+	}
+	row.Name = strings.TrimSpace(record[0])
+	row.Email = strings.ToLower(strings.TrimSpace(record[1]))
+
+	if len(row.Name) == 0 {
+		row.Errors = append(row.Errors, ErrUserNameInvalid.Error())
+	}
+	if !strings.Contains(row.Email, "@") {
+		row.Errors = append(row.Errors, ErrUserEmailInvalid.Error())
+	}
+	if group, err := strconv.ParseUint(strings.TrimSpace(record[2]), 10, 32); err != nil || u.Timetable == nil || !u.Timetable.GroupExists(uint(group)) {
+		row.Errors = append(row.Errors, ErrUserGroupInvalid.Error())
+	} else {
+		g := uint(group)
+		row.Group = &g
+	}
+	if seen[row.Email] {
+		row.Errors = append(row.Errors, ErrImportDuplicateEmail.Error())
+	}
+	seen[row.Email] = true
+	if len(row.Errors) > 0 {
+		row.Status = importStatusFailed
+		return row
+	}
+
+	user := models.User{}
+	res := db.First(&user, "lower(email) = ?", row.Email)
+	if res.Error != nil && !res.RecordNotFound() {
+		return failedRow(row, res.Error)
+	}
+
+	if !res.RecordNotFound() {
+		if existing == importExistingSkip {
+			row.Status = importStatusSkipped
+			return row
+		}
+		row.Status = importStatusMerged
+		if dryRun {
+			return row
+		}
+		if res := db.Model(&user).Updates(map[string]interface{}{"name": row.Name, "group": *row.Group}); res.Error != nil {
+			return failedRow(row, res.Error)
+		}
+		return row
+	}
+
+	if mode == importModeInvite {
+		row.Status = importStatusInvited
+		if dryRun {
+			return row
+		}
+		if err := u.invite(db, &row); err != nil {
+			return failedRow(row, err)
+		}
+		return row
+	}
+
+	row.Status = importStatusCreated
+	if dryRun {
+		return row
+	}
+	// pending accounts have no password, they are activated by signing in through the identity provider or after an admin sets a password
+	user = models.User{
+		Name:  row.Name,
+		Email: row.Email,
+		Group: row.Group,
+		Role:  models.RoleUser,
+	}
+	if res := db.Create(&user); res.Error != nil {
+		return failedRow(row, res.Error)
+	}
+	return row
+}
+
+// invite creates a single-use invitation for the row's email and group, it's mailed by mailInvitations once the import is committed
+func (u *Users) invite(db *gorm.DB, row *importRow) error {
+	if u.Mailer == nil {
+		return fmt.Errorf("%s: no mailer configured", ErrImportMailFailed)
+	}
+	invitation := &models.Invitation{
+		Email:   row.Email,
+		Role:    models.RoleUser,
+		Group:   row.Group,
+		MaxUses: 1,
+	}
+	token, err := invitation.Add(db)
+	if err != nil {
+		return err
+	}
+	row.invitation = invitation
+	row.token = token
+	return nil
+}
+
+// mailInvitations sends invitations of the committed import, invitations which couldn't be mailed are revoked
+// and their rows reported as failed
+func (u *Users) mailInvitations(report *importReport) {
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		if row.Status != importStatusInvited || row.invitation == nil {
+			continue
+		}
+		link := row.token
+		if target, err := url.Parse(os.Getenv("INVITATION_URL")); err == nil && len(target.String()) > 0 {
+			query := target.Query()
+			query.Set("token", row.token)
+			target.RawQuery = query.Encode()
+			link = target.String()
+		}
+		body := fmt.Sprintf("Cześć %s,\n\nzostałeś zaproszony do Platformy UEK. Aby założyć konto, otwórz link:\n\n%s\n\nZaproszenie jest ważne przez 7 dni.", row.Name, link)
+		if err := u.Mailer.Send(row.Email, "Zaproszenie do Platformy UEK", body); err != nil {
+			u.Database.Unscoped().Delete(row.invitation)
+			*row = failedRow(*row, fmt.Errorf("%s: %s", ErrImportMailFailed, err))
+			report.Invited--
+			report.Failed++
+		}
+	}
+}
+
+func failedRow(row importRow, err error) importRow {
+	row.Status = importStatusFailed
+	if strings.HasPrefix(err.Error(), ErrImportMailFailed.Error()) {
+		row.Errors = append(row.Errors, ErrImportMailFailed.Error())
+	} else {
+		row.Errors = append(row.Errors, models.ErrUsersUnknown.Error())
+	}
+	if os.Getenv("DEBUG") == "TRUE" {
+		row.DebugErrors = append(row.DebugErrors, err.Error())
+	}
+	return row
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+var ErrInvitationNotFound = errors.New("invitation not found")
+
+type invitationResponse struct {
+	models.Invitation
+	Token string `json:"token"`
+}
+
+// Invitations lets admins onboard users with a preset role and group
+type Invitations struct {
+	Database  *gorm.DB
+	Timetable *timetable.Coordinator
+}
+
+func (i *Invitations) Register(router *mux.Router) {
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(i.HandleGetAll))).Methods(http.MethodGet)
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(i.HandleAdd))).Methods(http.MethodPost)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(i.HandleDelete))).Methods(http.MethodDelete)
+}
+
+func (i *Invitations) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
+	invitations := []models.Invitation{}
+	if res := i.Database.Order("id").Find(&invitations); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&invitations)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleAdd creates an invitation, the token is only returned in this response
+func (i *Invitations) HandleAdd(rw http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	invitation := models.Invitation{}
+	if err := decoder.Decode(&invitation); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+	invitation.ID = 0
+	invitation.CreatedByID = admin.ID
+
+	groups := invitation.ModeratedGroups()
+	if invitation.Group != nil {
+		groups = append(groups, *invitation.Group)
+	}
+	for _, group := range groups {
+		if i.Timetable == nil || !i.Timetable.GroupExists(group) {
+			utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusBadRequest, rw)
+			return
+		}
+	}
+
+	tx := beginAudited(rw, i.Database)
+	if tx == nil {
+		return
+	}
+	token, err := invitation.Add(tx)
+	if err != nil {
+		tx.Rollback()
+		if res, ok := err.(*utils.ErrorResponse); ok {
+			res.Write(http.StatusBadRequest, rw)
+			return
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if !audit(rw, r, tx, models.AuditInvitationCreate, "invitation", invitation.ID, nil, invitation) {
+		return
+	}
+
+	byt, err := json.Marshal(&invitationResponse{Invitation: invitation, Token: token})
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleDelete revokes the invitation, accounts already created with it are kept
+func (i *Invitations) HandleDelete(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationIDInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	tx := beginAudited(rw, i.Database)
+	if tx == nil {
+		return
+	}
+	res := tx.Delete(&models.Invitation{Model: gorm.Model{ID: uint(id)}})
+	if res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		utils.NewErrorResponse(ErrInvitationNotFound).Write(http.StatusNotFound, rw)
+		return
+	}
+	if !audit(rw, r, tx, models.AuditInvitationRevoke, "invitation", uint(id), nil, nil) {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
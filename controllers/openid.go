@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/oidc"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	openIDStateLength = 24
+	// openIDStateCookie ties a login to the browser which started it, it holds a hash of the state
+	openIDStateCookie = "oidc_state"
+)
+
+var (
+	ErrOpenIDStateInvalid    = errors.New("login state invalid or expired")
+	ErrOpenIDFailed          = errors.New("could not log in with the identity provider")
+	ErrOpenIDEmailUnverified = errors.New("identity provider did not verify the email")
+)
+
+func (a *Accounts) registerOpenID(router *mux.Router) {
+	if a.OpenID == nil {
+		return
+	}
+	router.HandleFunc("/oidc/login/", a.HandleOpenIDLogin).Methods(http.MethodGet)
+	router.HandleFunc("/oidc/callback/", a.HandleOpenIDCallback).Methods(http.MethodGet)
+}
+
+// HandleOpenIDLogin redirects the browser to the identity provider.
+// Every login is kept until the callback, so starting them counts towards the client address's limit.
+func (a *Accounts) HandleOpenIDLogin(rw http.ResponseWriter, r *http.Request) {
+	ipKey := "oidc:" + utils.ClientIP(r)
+	if !a.allowed(rw, a.IPThrottle, ipKey) {
+		return
+	}
+	a.fail(a.IPThrottle, ipKey)
+
+	state, err := utils.RandomString(openIDStateLength)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	nonce, err := utils.RandomString(openIDStateLength)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	target, err := a.OpenID.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrOpenIDFailed.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadGateway, rw)
+		return
+	}
+	if err := a.OpenIDLogins.Put(state, nonce, verifier); err != nil {
+		utils.NewErrorResponse(err).Write(http.StatusServiceUnavailable, rw)
+		return
+	}
+	http.SetCookie(rw, a.openIDStateCookie(utils.HashToken(state), int(a.OpenIDLogins.Lifetime.Seconds())))
+	http.Redirect(rw, r, target, http.StatusFound)
+}
+
+// openIDStateCookie is scoped to the callback and sent on the provider's redirect back, but not to requests of other sites
+func (a *Accounts) openIDStateCookie(value string, maxAge int) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     openIDStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if callback, err := url.Parse(a.OpenID.RedirectURL); err == nil {
+		if len(callback.Path) > 0 {
+			cookie.Path = callback.Path
+		}
+		cookie.Secure = callback.Scheme == "https"
+	}
+	return cookie
+}
+
+// HandleOpenIDCallback exchanges the code, maps the identity to a user and finishes the login like a password login would.
+// If OIDC_FRONTEND_URL is set the result is passed to the frontend in the url fragment instead of the response body.
+func (a *Accounts) HandleOpenIDCallback(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); len(errCode) > 0 {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrOpenIDFailed.Error()},
+			DebugErrors: []string{errCode + ": " + query.Get("error_description")},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// the callback has to come to the browser which started the login, otherwise a login started by someone else
+	// could be finished in the victim's browser
+	cookie, err := r.Cookie(openIDStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(utils.HashToken(query.Get("state")))) != 1 {
+		utils.NewErrorResponse(ErrOpenIDStateInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	http.SetCookie(rw, a.openIDStateCookie("", -1))
+
+	pending := a.OpenIDLogins.Take(query.Get("state"))
+	if pending == nil {
+		utils.NewErrorResponse(ErrOpenIDStateInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	identity, err := a.OpenID.Exchange(query.Get("code"), pending.Verifier, pending.Nonce)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrOpenIDFailed.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusUnauthorized, rw)
+		return
+	}
+
+	user, err := a.openIDUser(identity)
+	if err != nil {
+		if err == ErrOpenIDEmailUnverified {
+			utils.NewErrorResponse(err).Write(http.StatusForbidden, rw)
+			return
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if user.Deactivated {
+		utils.NewErrorResponse(ErrUserDeactivated).Write(http.StatusForbidden, rw)
+		return
+	}
+	user.Password = ""
+
+	frontend := os.Getenv("OIDC_FRONTEND_URL")
+	if len(frontend) == 0 {
+		a.completeLogin(rw, r, user)
+		return
+	}
+
+	resp, err := a.loginResponse(r, user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	fragment := url.Values{}
+	if len(resp.Token) > 0 {
+		fragment.Set("token", resp.Token)
+	}
+	if resp.MFARequired {
+		fragment.Set("mfa_token", resp.MFAToken)
+	}
+	if resp.MFAEnrolmentRequired {
+		fragment.Set("mfa_enrolment_required", "true")
+	}
+	http.Redirect(rw, r, strings.Split(frontend, "#")[0]+"#"+fragment.Encode(), http.StatusFound)
+}
+
+// openIDUser finds the user linked to the identity, links an account with the same email or creates a new one
+func (a *Accounts) openIDUser(identity *oidc.IDToken) (*models.User, error) {
+	user := &models.User{}
+	res := a.Database.First(user, "open_id_subject = ?", identity.Subject)
+	if res.Error == nil {
+		return user, nil
+	} else if !res.RecordNotFound() {
+		return nil, res.Error
+	}
+
+	if len(identity.Email) == 0 || !identity.EmailVerified {
+		return nil, ErrOpenIDEmailUnverified
+	}
+
+	res = a.Database.First(user, "email = ?", identity.Email)
+	if res.Error != nil && !res.RecordNotFound() {
+		return nil, res.Error
+	}
+	if res.RecordNotFound() {
+		user = &models.User{
+			Name:  identity.Name,
+			Email: identity.Email,
+			Role:  models.RoleUser,
+		}
+		if len(user.Name) == 0 {
+			user.Name = strings.Split(identity.Email, "@")[0]
+		}
+	}
+	user.OpenIDSubject = identity.Subject
+
+	if res := a.Database.Save(user); res.Error != nil {
+		return nil, fmt.Errorf("could not save user: %s", res.Error.Error())
+	}
+	return user, nil
+}
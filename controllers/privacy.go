@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+type accountDeletionRequest struct {
+	Password string `json:"password"`
+}
+
+func (a *Accounts) registerPrivacy(router *mux.Router) {
+	router.Handle("/me/export/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleExport))).Methods(http.MethodGet)
+	router.Handle("/me/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleDeleteMe))).Methods(http.MethodDelete)
+}
+
+// HandleExport returns all personal data of the user, as a zip archive by default or as a single json document if format=json
+func (a *Accounts) HandleExport(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+
+	export, err := user.Export(a.Database)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("could not export user's data: %s", err.Error())},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" {
+		byt, err := json.Marshal(export)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(byt)
+		return
+	}
+
+	files := map[string]interface{}{
+		"user.json":          export.User,
+		"subscriptions.json": export.Subscriptions,
+		"interactions.json":  export.Interactions,
+		"events.json":        export.Events,
+		"moderates.json":     export.Moderates,
+		"sessions.json":      export.Sessions,
+	}
+	contents := map[string][]byte{}
+	for name, data := range files {
+		byt, err := json.MarshalIndent(data, "", "    ")
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		contents[name] = byt
+	}
+
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"bruschetta-export-%d-%s.zip\"", user.ID, time.Now().Format("20060102")))
+	rw.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(rw)
+	for name, byt := range contents {
+		f, err := archive.Create(name)
+		if err != nil {
+			return
+		}
+		if _, err := f.Write(byt); err != nil {
+			return
+		}
+	}
+	archive.Close()
+}
+
+// HandleDeleteMe permanently removes user's account and personal data, the password has to be confirmed
+func (a *Accounts) HandleDeleteMe(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := accountDeletionRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	dbUser := models.User{}
+	if res := a.Database.First(&dbUser, user.ID); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("error occured while querying the database: %s", res.Error.Error())},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if !dbUser.HasPassword() {
+		utils.NewErrorResponse(ErrUserPasswordNotSet).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if !dbUser.CheckPassword(req.Password) {
+		utils.NewErrorResponse(ErrUserCurrentPasswordInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if err := dbUser.Forget(a.Database); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("could not delete user's data: %s", err.Error())},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	emailTokenLength   = 24
+	emailTokenLifetime = 48 * time.Hour
+)
+
+var (
+	ErrUserEmailTokenInvalid = errors.New("email verification token invalid or expired")
+	ErrUserEmailNotSent      = errors.New("could not send verification email")
+)
+
+type profilePatch struct {
+	Name   *string `json:"name"`
+	Email  *string `json:"email"`
+	Group  *uint   `json:"group"`
+	Groups *[]uint `json:"groups"`
+	// MuteUnselectedChanges silences changes of classes the user didn't select instead of sending them at low priority
+	MuteUnselectedChanges *bool `json:"mute_unselected_changes"`
+	ReminderMinutes       *uint `json:"reminder_minutes"`
+}
+
+type classSelections struct {
+	Classes []models.ClassSelection `json:"classes"`
+}
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+func (a *Accounts) registerProfile(router *mux.Router) {
+	router.Handle("/me/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleGetMe))).Methods(http.MethodGet)
+	router.Handle("/me/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandlePatchMe))).Methods(http.MethodPatch)
+	router.Handle("/me/classes/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleGetClasses))).Methods(http.MethodGet)
+	router.Handle("/me/classes/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandlePutClasses))).Methods(http.MethodPut)
+	router.Handle("/me/password/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleChangePassword))).Methods(http.MethodPost)
+	router.HandleFunc("/verify/{token}/", a.HandleVerifyEmail).Methods(http.MethodGet, http.MethodPost)
+}
+
+func (a *Accounts) HandleGetMe(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	if err := user.LoadGroups(a.Database); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+func (a *Accounts) HandlePatchMe(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	patch := profilePatch{}
+	if err := decoder.Decode(&patch); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// validate input
+	errors := []error{}
+	if patch.Name != nil && len(strings.TrimSpace(*patch.Name)) == 0 {
+		errors = append(errors, ErrUserNameInvalid)
+	}
+	if patch.Email != nil && !strings.Contains(*patch.Email, "@") {
+		errors = append(errors, ErrUserEmailInvalid)
+	}
+	if patch.Group != nil && (a.Timetable == nil || !a.Timetable.GroupExists(*patch.Group)) {
+		errors = append(errors, ErrUserGroupInvalid)
+	}
+	if patch.Groups != nil {
+		for _, group := range *patch.Groups {
+			if a.Timetable == nil || !a.Timetable.GroupExists(group) {
+				errors = append(errors, ErrUserGroupInvalid)
+				break
+			}
+		}
+	}
+	if patch.ReminderMinutes != nil && *patch.ReminderMinutes > models.MaximumReminderMinutes {
+		errors = append(errors, ErrUserReminderInvalid)
+	}
+	if len(errors) != 0 {
+		utils.NewErrorResponse(errors...).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if patch.Name != nil {
+		updates["name"] = strings.TrimSpace(*patch.Name)
+	}
+	if patch.Group != nil {
+		updates["group"] = *patch.Group
+	}
+	if patch.MuteUnselectedChanges != nil {
+		updates["mute_unselected_changes"] = *patch.MuteUnselectedChanges
+	}
+	if patch.ReminderMinutes != nil {
+		updates["reminder_minutes"] = *patch.ReminderMinutes
+	}
+
+	// email change takes effect only after the new address is verified
+	var token string
+	if patch.Email != nil && *patch.Email != user.Email {
+		var existingUser models.User
+		if res := a.Database.First(&existingUser, "email = ?", *patch.Email); !res.RecordNotFound() {
+			utils.NewErrorResponse(ErrUserEmailRegistered).Write(http.StatusBadRequest, rw)
+			return
+		}
+
+		tok, err := utils.RandomString(emailTokenLength)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		token = tok
+		expiresAt := time.Now().Add(emailTokenLifetime)
+		updates["pending_email"] = *patch.Email
+		updates["email_token"] = utils.HashToken(token)
+		updates["email_token_expires_at"] = &expiresAt
+	}
+
+	if len(updates) > 0 {
+		if res := a.Database.Model(user).Updates(updates); res.Error != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{res.Error.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		if res := a.Database.First(user, user.ID); res.Error != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{res.Error.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		user.Password = ""
+	}
+
+	if patch.Groups != nil {
+		if err := user.SetGroups(a.Database, *patch.Groups); err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAccountsUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+	}
+
+	if len(token) > 0 {
+		if err := a.sendVerificationEmail(*patch.Email, token); err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrUserEmailNotSent.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+	}
+
+	a.HandleGetMe(rw, r)
+}
+
+// HandleGetClasses lists classes the user attends, an empty list means all classes of the user's groups
+func (a *Accounts) HandleGetClasses(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	selections, err := models.UserClassSelections(a.Database, user.ID)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrClassSelectionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&classSelections{Classes: selections})
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrClassSelectionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandlePutClasses replaces classes the user attends, timetable changes are then sent at full priority only if they affect them
+func (a *Accounts) HandlePutClasses(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	request := classSelections{}
+	if err := decoder.Decode(&request); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrClassSelectionsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if err := models.SetClassSelections(a.Database, user.ID, request.Classes); err == models.ErrClassSelectionInvalid {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrClassSelectionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	a.HandleGetClasses(rw, r)
+}
+
+func (a *Accounts) sendVerificationEmail(email, token string) error {
+	if a.Mailer == nil {
+		return errors.New("no mailer configured")
+	}
+	link := fmt.Sprintf("%s/accounts/verify/%s/", strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"), token)
+	body := fmt.Sprintf("Aby potwierdzić nowy adres email w Platformie UEK, otwórz link:\n\n%s\n\nJeśli to nie Ty zmieniałeś adres, zignoruj tę wiadomość.", link)
+	return a.Mailer.Send(email, "Potwierdź adres email", body)
+}
+
+func (a *Accounts) HandleVerifyEmail(rw http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	user := models.User{}
+	res := a.Database.First(&user, "email_token = ?", utils.HashToken(token))
+	if res.Error != nil && !res.RecordNotFound() {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res.RecordNotFound() || user.EmailTokenExpiresAt == nil || user.EmailTokenExpiresAt.Before(time.Now()) || len(user.PendingEmail) == 0 {
+		utils.NewErrorResponse(ErrUserEmailTokenInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// the address might have been taken since the change was requested
+	var existingUser models.User
+	if res := a.Database.First(&existingUser, "email = ?", user.PendingEmail); !res.RecordNotFound() {
+		utils.NewErrorResponse(ErrUserEmailRegistered).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if res := a.Database.Model(&user).Updates(map[string]interface{}{
+		"email":                  user.PendingEmail,
+		"pending_email":          "",
+		"email_token":            "",
+		"email_token_expires_at": nil,
+	}); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (a *Accounts) HandleChangePassword(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := passwordChangeRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if len(req.Password) == 0 {
+		utils.NewErrorResponse(ErrUserPasswordInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if err := models.ValidatePassword(req.Password); err != nil {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	// the user in context has its password stripped
+	dbUser := models.User{}
+	if res := a.Database.First(&dbUser, user.ID); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("error occured while querying the database: %s", res.Error.Error())},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	// accounts without a password can set the first one without the current one, it's how they confirm
+	// deleting the account or disabling two-factor authentication later on
+	first := !dbUser.HasPassword()
+	if !first && !dbUser.CheckPassword(req.CurrentPassword) {
+		utils.NewErrorResponse(ErrUserCurrentPasswordInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if err := dbUser.SetPassword(req.Password); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("could not encrypt user's password: %s", err)},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	res := a.Database.Model(&dbUser)
+	if first {
+		// a password set concurrently has to be confirmed
+		res = res.Where("password = ?", "")
+	}
+	if res = res.Update("password", dbUser.Password); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res.RowsAffected == 0 {
+		utils.NewErrorResponse(ErrUserCurrentPasswordInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
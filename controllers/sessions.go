@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+func (a *Accounts) registerSessions(router *mux.Router) {
+	router.Handle("/sessions/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleGetSessions))).Methods(http.MethodGet)
+	router.Handle("/sessions/{session:[0-9]+}/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleRevokeSession))).Methods(http.MethodDelete)
+}
+
+// HandleGetSessions lists devices the user is logged in on
+func (a *Accounts) HandleGetSessions(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	writeSessions(rw, r, a.Database, user.ID)
+}
+
+// HandleRevokeSession logs the user out on a device, the current session can be revoked as well
+func (a *Accounts) HandleRevokeSession(rw http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	revokeSession(rw, r, a.Database, user.ID, false)
+}
+
+// HandleGetSessions lists devices the user is logged in on
+func (u *Users) HandleGetSessions(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+	writeSessions(rw, r, u.Database, user.ID)
+}
+
+// HandleRevokeSession logs the user out on a device
+func (u *Users) HandleRevokeSession(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+	revokeSession(rw, r, u.Database, user.ID, true)
+}
+
+func writeSessions(rw http.ResponseWriter, r *http.Request, db *gorm.DB, userID uint) {
+	sessions, err := models.UserSessions(db, userID)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSessionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if current, ok := r.Context().Value(middleware.ContextSessionKey).(*models.Session); ok {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.ID
+		}
+	}
+
+	byt, err := json.Marshal(&sessions)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSessionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// revokeSession revokes one of the user's sessions, audited is set when an admin acts on someone else's behalf
+func revokeSession(rw http.ResponseWriter, r *http.Request, db *gorm.DB, userID uint, audited bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["session"])
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSessionIDInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if audited {
+		if db = beginAudited(rw, db); db == nil {
+			return
+		}
+	}
+	if err := models.RevokeSession(db, userID, uint(id)); err == models.ErrSessionNotFound {
+		if audited {
+			db.Rollback()
+		}
+		utils.NewErrorResponse(err).Write(http.StatusNotFound, rw)
+		return
+	} else if err != nil {
+		if audited {
+			db.Rollback()
+		}
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSessionsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if audited && !audit(rw, r, db, models.AuditSessionRevoke, "session", uint(id), nil, map[string]uint{"user_id": userID}) {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
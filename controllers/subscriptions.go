@@ -3,11 +3,13 @@ package controllers
 import (
 	"net/http"
 	"strconv"
+	"strings"
 
 	"encoding/json"
 
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/channels"
 	"github.com/maciekmm/uek-bruschetta/middleware"
 	"github.com/maciekmm/uek-bruschetta/models"
 	"github.com/maciekmm/uek-bruschetta/utils"
@@ -17,6 +19,49 @@ type Subscriptions struct {
 	Database *gorm.DB
 }
 
+// owner resolves whose subscriptions are managed. Admins may pass ?user_id= to act on behalf of another user,
+// such actions are recorded in the audit log. It writes an error response and returns nil if it's not possible.
+func (s *Subscriptions) owner(rw http.ResponseWriter, r *http.Request) (owner *models.User, onBehalf bool) {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	raw := r.URL.Query().Get("user_id")
+	if len(raw) == 0 {
+		return user, false
+	}
+
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUserIDInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return nil, false
+	}
+	if uint(id) == user.ID {
+		return user, false
+	}
+	if user.Role < models.RoleAdmin {
+		utils.NewErrorResponse(middleware.ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
+		return nil, false
+	}
+	if mfa, _ := r.Context().Value(middleware.ContextMFAKey).(bool); user.TwoFactorRequired() && !mfa {
+		utils.NewErrorResponse(middleware.ErrAuthTwoFactor).Write(http.StatusUnauthorized, rw)
+		return nil, false
+	}
+
+	owner = &models.User{}
+	if res := s.Database.First(owner, uint(id)); res.RecordNotFound() {
+		utils.NewErrorResponse(ErrUserNotFound).Write(http.StatusNotFound, rw)
+		return nil, false
+	} else if res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSubscriptionsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil, false
+	}
+	return owner, true
+}
+
 func (s *Subscriptions) Register(router *mux.Router) {
 	router.Handle("/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(s.HandleAdd))).Methods(http.MethodPost)
 	router.Handle("/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(s.HandleGetAll))).Methods(http.MethodGet)
@@ -26,7 +71,10 @@ func (s *Subscriptions) Register(router *mux.Router) {
 }
 
 func (s *Subscriptions) HandleAdd(rw http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user, onBehalf := s.owner(rw, r)
+	if user == nil {
+		return
+	}
 
 	decoder := json.NewDecoder(r.Body)
 	defer r.Body.Close()
@@ -39,7 +87,20 @@ func (s *Subscriptions) HandleAdd(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 	subscription.UserID = user.ID
-	if err := subscription.Add(s.Database); err != nil {
+	if !ownsChannelID(&subscription, user) {
+		utils.NewErrorResponse(models.ErrSubscriptionEmailInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	db := s.Database
+	if onBehalf {
+		if db = beginAudited(rw, s.Database); db == nil {
+			return
+		}
+	}
+	if err := subscription.Add(db); err != nil {
+		if onBehalf {
+			db.Rollback()
+		}
 		if res, ok := err.(*utils.ErrorResponse); ok {
 			res.Write(http.StatusBadRequest, rw)
 			return
@@ -50,11 +111,17 @@ func (s *Subscriptions) HandleAdd(rw http.ResponseWriter, r *http.Request) {
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if onBehalf && !audit(rw, r, db, models.AuditSubscriptionCreate, "subscription", subscription.ID, nil, &subscription) {
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
 func (s *Subscriptions) HandleDelete(rw http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user, onBehalf := s.owner(rw, r)
+	if user == nil {
+		return
+	}
 	vars := mux.Vars(r)
 
 	id, err := strconv.Atoi(vars["id"])
@@ -66,18 +133,40 @@ func (s *Subscriptions) HandleDelete(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if res := s.Database.Where("id = ? AND user_id = ?", uint(id), user.ID).Delete(&models.Subscription{}); res.Error != nil {
+	var before *models.Subscription
+	if onBehalf {
+		if before = s.snapshot(rw, uint(id), user.ID); before == nil {
+			return
+		}
+	}
+
+	db := s.Database
+	if onBehalf {
+		if db = beginAudited(rw, s.Database); db == nil {
+			return
+		}
+	}
+	if res := db.Where("id = ? AND user_id = ?", uint(id), user.ID).Delete(&models.Subscription{}); res.Error != nil {
+		if onBehalf {
+			db.Rollback()
+		}
 		(&utils.ErrorResponse{
 			Errors:      []string{models.ErrEventsUnknown.Error()},
 			DebugErrors: []string{res.Error.Error()},
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if onBehalf && !audit(rw, r, db, models.AuditSubscriptionDelete, "subscription", uint(id), before, nil) {
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
 func (s *Subscriptions) HandlePatch(rw http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user, onBehalf := s.owner(rw, r)
+	if user == nil {
+		return
+	}
 	vars := mux.Vars(r)
 
 	id, err := strconv.Atoi(vars["id"])
@@ -100,24 +189,85 @@ func (s *Subscriptions) HandlePatch(rw http.ResponseWriter, r *http.Request) {
 		}).Write(http.StatusBadRequest, rw)
 		return
 	}
+	if errs := sub.ValidateDigest(); len(errs) > 0 {
+		utils.NewErrorResponse(errs...).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	before := s.snapshot(rw, uint(id), user.ID)
+	if before == nil {
+		return
+	}
+	merged := *before
+	if len(sub.Channel) > 0 {
+		merged.Channel = sub.Channel
+	}
+	if len(sub.ChannelID) > 0 {
+		merged.ChannelID = sub.ChannelID
+	}
+	if !ownsChannelID(&merged, user) {
+		utils.NewErrorResponse(models.ErrSubscriptionEmailInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
 
 	sub.UserID = user.ID
 	model := models.Subscription{}
 	model.ID = uint(id)
 	model.UserID = user.ID
 
-	if res := s.Database.Model(&model).Updates(&sub); res.Error != nil {
+	db := s.Database
+	if onBehalf {
+		if db = beginAudited(rw, s.Database); db == nil {
+			return
+		}
+	}
+	if res := db.Model(&model).Updates(&sub); res.Error != nil {
+		if onBehalf {
+			db.Rollback()
+		}
 		(&utils.ErrorResponse{
 			Errors:      []string{models.ErrSubscriptionsUnknown.Error()},
 			DebugErrors: []string{res.Error.Error()},
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	if onBehalf {
+		after := &models.Subscription{}
+		db.Where("id = ? AND user_id = ?", uint(id), user.ID).First(after)
+		if !audit(rw, r, db, models.AuditSubscriptionUpdate, "subscription", uint(id), before, after) {
+			return
+		}
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
+// ownsChannelID reports whether the channel id can be used by the owner, email subscriptions have to use the owner's email,
+// which is verified before it's changed, so that nobody can subscribe other addresses
+func ownsChannelID(sub *models.Subscription, owner *models.User) bool {
+	return sub.Channel != channels.ChannelTypeEmail || strings.EqualFold(strings.TrimSpace(sub.ChannelID), owner.Email)
+}
+
+// snapshot loads the user's subscription, it writes an error response and returns nil if it's not possible
+func (s *Subscriptions) snapshot(rw http.ResponseWriter, id, userID uint) *models.Subscription {
+	sub := &models.Subscription{}
+	if res := s.Database.Where("id = ? AND user_id = ?", id, userID).First(sub); res.RecordNotFound() {
+		utils.NewErrorResponse(models.ErrSubscriptionIDInvalid).Write(http.StatusNotFound, rw)
+		return nil
+	} else if res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrSubscriptionsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	return sub
+}
+
 func (s *Subscriptions) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user, _ := s.owner(rw, r)
+	if user == nil {
+		return
+	}
 
 	subs := []models.Subscription{}
 	if res := s.Database.Unscoped().Where("user_id = ?", user.ID).Order("channel").Find(&subs); res.Error != nil {
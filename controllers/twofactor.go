@@ -0,0 +1,486 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/totp"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	mfaChallengeAudience = "mfa"
+	mfaChallengeLifetime = 5 * time.Minute
+	totpIssuer           = "Platforma UEK"
+	totpSkew             = 1
+)
+
+var (
+	ErrTwoFactorCodeInvalid      = errors.New("two-factor code invalid")
+	ErrTwoFactorChallengeInvalid = errors.New("two-factor challenge invalid or expired")
+	ErrTwoFactorEnabled          = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnrolled      = errors.New("two-factor authentication not enrolled")
+	ErrTwoFactorRequired         = errors.New("two-factor authentication is mandatory for this account")
+)
+
+type mfaChallengeClaims struct {
+	jwt.StandardClaims
+	UserID uint `json:"user_id"`
+}
+
+type twoFactorLoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type twoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type twoFactorEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type twoFactorConfirmation struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	Token         string   `json:"token,omitempty"`
+}
+
+func (a *Accounts) registerTwoFactor(router *mux.Router) {
+	router.HandleFunc("/login/2fa/", a.HandleLoginTwoFactor).Methods(http.MethodPost)
+	router.Handle("/me/2fa/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleEnrolTwoFactor))).Methods(http.MethodPost)
+	router.Handle("/me/2fa/confirm/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleConfirmTwoFactor))).Methods(http.MethodPost)
+	router.Handle("/me/2fa/recovery-codes/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleRegenerateRecoveryCodes))).Methods(http.MethodPost)
+	router.Handle("/me/2fa/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(a.HandleDisableTwoFactor))).Methods(http.MethodDelete)
+}
+
+// completeLogin is called once the first factor is verified, it either issues a token or a two-factor challenge
+func (a *Accounts) completeLogin(rw http.ResponseWriter, r *http.Request, user *models.User) {
+	resp, err := a.loginResponse(r, user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	body, _ := json.Marshal(resp)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+func (a *Accounts) loginResponse(r *http.Request, user *models.User) (*jwtResponse, error) {
+	resp := &jwtResponse{}
+	if user.TOTPEnabled {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, mfaChallengeClaims{
+			StandardClaims: jwt.StandardClaims{
+				Audience:  mfaChallengeAudience,
+				ExpiresAt: time.Now().Add(mfaChallengeLifetime).Unix(),
+			},
+			UserID: user.ID,
+		})
+		tok, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+		if err != nil {
+			return nil, fmt.Errorf("error occured while generating challenge: %s", err)
+		}
+		resp.MFARequired = true
+		resp.MFAToken = tok
+		return resp, nil
+	}
+
+	tok, err := a.issueToken(r, user, false)
+	if err != nil {
+		return nil, err
+	}
+	resp.Token = tok
+	resp.MFAEnrolmentRequired = user.TwoFactorRequired()
+	return resp, nil
+}
+
+// HandleLoginTwoFactor finishes a login started with a password by verifying a TOTP or recovery code
+func (a *Accounts) HandleLoginTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := twoFactorLoginRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	claims := &mfaChallengeClaims{}
+	tok, err := jwt.ParseWithClaims(req.MFAToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("invalid signing method")
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+	if err != nil || !tok.Valid || !claims.VerifyAudience(mfaChallengeAudience, true) {
+		utils.NewErrorResponse(ErrTwoFactorChallengeInvalid).Write(http.StatusUnauthorized, rw)
+		return
+	}
+
+	key := "mfa:" + strconv.Itoa(int(claims.UserID))
+	if !a.allowed(rw, a.AccountThrottle, key) {
+		return
+	}
+
+	user := models.User{}
+	if res := a.Database.First(&user, claims.UserID); res.Error != nil {
+		utils.NewErrorResponse(ErrTwoFactorChallengeInvalid).Write(http.StatusUnauthorized, rw)
+		return
+	}
+	if user.Deactivated {
+		utils.NewErrorResponse(ErrUserDeactivated).Write(http.StatusForbidden, rw)
+		return
+	}
+
+	ok := false
+	if len(req.RecoveryCode) > 0 {
+		ok, err = models.UseRecoveryCode(a.Database, user.ID, req.RecoveryCode)
+	} else {
+		ok, err = a.verifyTOTP(&user, req.Code)
+	}
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !ok {
+		a.fail(a.AccountThrottle, key)
+		utils.NewErrorResponse(ErrTwoFactorCodeInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if a.AccountThrottle != nil {
+		a.AccountThrottle.Succeed(key)
+	}
+
+	user.Password = ""
+	token, err := a.issueToken(r, &user, true)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	body, _ := json.Marshal(&jwtResponse{
+		Token: token,
+	})
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// verifyTOTP checks the code against user's secret, codes can't be reused
+func (a *Accounts) verifyTOTP(user *models.User, code string) (bool, error) {
+	if len(user.TOTPSecret) == 0 {
+		return false, nil
+	}
+	step, ok := totp.Verify(user.TOTPSecret, code, time.Now(), totpSkew, user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	// the condition guards against the same code being used concurrently
+	res := a.Database.Model(&models.User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).UpdateColumn("totp_last_step", step)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	user.TOTPLastStep = step
+	return res.RowsAffected == 1, nil
+}
+
+// loadUser fetches the context user along with the fields stripped from tokens
+func (a *Accounts) loadUser(rw http.ResponseWriter, r *http.Request) *models.User {
+	user := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	dbUser := &models.User{}
+	if res := a.Database.First(dbUser, user.ID); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{fmt.Sprintf("error occured while querying the database: %s", res.Error.Error())},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	return dbUser
+}
+
+// HandleEnrolTwoFactor generates a new secret, it has to be confirmed with a code before it's used
+func (a *Accounts) HandleEnrolTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(rw, r)
+	if user == nil {
+		return
+	}
+	if user.TOTPEnabled {
+		utils.NewErrorResponse(ErrTwoFactorEnabled).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if res := a.Database.Model(user).Update("totp_secret", secret); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	body, _ := json.Marshal(&twoFactorEnrolment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, totpIssuer, user.Email),
+	})
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// HandleConfirmTwoFactor enables two-factor authentication and returns recovery codes along with a token which satisfies the admin policy
+func (a *Accounts) HandleConfirmTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	// the session is upgraded rather than a new one started, tokens without one can't be upgraded
+	session, ok := r.Context().Value(middleware.ContextSessionKey).(*models.Session)
+	if !ok {
+		utils.NewErrorResponse(middleware.ErrAuthSessionRevoked).Write(http.StatusUnauthorized, rw)
+		return
+	}
+	user := a.loadUser(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := twoFactorRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if user.TOTPEnabled {
+		utils.NewErrorResponse(ErrTwoFactorEnabled).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if len(user.TOTPSecret) == 0 {
+		utils.NewErrorResponse(ErrTwoFactorNotEnrolled).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	ok, err := a.verifyTOTP(user, req.Code)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !ok {
+		utils.NewErrorResponse(ErrTwoFactorCodeInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	codes, err := models.GenerateRecoveryCodes(a.Database, user.ID)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	if res := a.Database.Model(user).Update("totp_enabled", true); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	user.Password = ""
+	user.TOTPEnabled = true
+	token, err := a.generateJWT(user, true, session.Family)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	body, _ := json.Marshal(&twoFactorConfirmation{
+		RecoveryCodes: codes,
+		Token:         token,
+	})
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// HandleRegenerateRecoveryCodes invalidates all recovery codes and returns new ones, a valid TOTP code is required.
+// Wrong codes are throttled together with the ones of the login challenge.
+func (a *Accounts) HandleRegenerateRecoveryCodes(rw http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := twoFactorRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		utils.NewErrorResponse(ErrTwoFactorNotEnrolled).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	key := "mfa:" + strconv.Itoa(int(user.ID))
+	if !a.allowed(rw, a.AccountThrottle, key) {
+		return
+	}
+	ok, err := a.verifyTOTP(user, req.Code)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !ok {
+		a.fail(a.AccountThrottle, key)
+		utils.NewErrorResponse(ErrTwoFactorCodeInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if a.AccountThrottle != nil {
+		a.AccountThrottle.Succeed(key)
+	}
+
+	codes, err := models.GenerateRecoveryCodes(a.Database, user.ID)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	body, _ := json.Marshal(&twoFactorConfirmation{
+		RecoveryCodes: codes,
+	})
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+// HandleDisableTwoFactor turns two-factor authentication off, it requires both the password and a TOTP code.
+// Wrong passwords and codes are throttled together with the codes of the login challenge.
+func (a *Accounts) HandleDisableTwoFactor(rw http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := twoFactorRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error(), fmt.Sprintf("could not decode request body")},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if user.TwoFactorRequired() {
+		utils.NewErrorResponse(ErrTwoFactorRequired).Write(http.StatusForbidden, rw)
+		return
+	}
+	if !user.TOTPEnabled {
+		utils.NewErrorResponse(ErrTwoFactorNotEnrolled).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if !user.HasPassword() {
+		utils.NewErrorResponse(ErrUserPasswordNotSet).Write(http.StatusBadRequest, rw)
+		return
+	}
+	key := "mfa:" + strconv.Itoa(int(user.ID))
+	if !a.allowed(rw, a.AccountThrottle, key) {
+		return
+	}
+	if !user.CheckPassword(req.Password) {
+		a.fail(a.AccountThrottle, key)
+		utils.NewErrorResponse(ErrUserCurrentPasswordInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	ok, err := a.verifyTOTP(user, req.Code)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !ok {
+		a.fail(a.AccountThrottle, key)
+		utils.NewErrorResponse(ErrTwoFactorCodeInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if a.AccountThrottle != nil {
+		a.AccountThrottle.Succeed(key)
+	}
+
+	tx := a.Database.Begin()
+	if res := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}); res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res := tx.Model(user).Updates(map[string]interface{}{
+		"totp_enabled": false,
+		"totp_secret":  "",
+	}); res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if res := tx.Commit(); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAccountsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,508 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/mail"
+	"github.com/maciekmm/uek-bruschetta/middleware"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/timetable"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	usersDefaultLimit       = 50
+	usersMaximumLimit       = 500
+	generatedPasswordLength = 12
+)
+
+var (
+	ErrUserNotFound         = errors.New("user not found")
+	ErrUserSelfModification = errors.New("you can't change your own role or deactivate yourself")
+	ErrLockoutNotFound      = errors.New("lockout not found")
+)
+
+type userPatch struct {
+	Role   *models.UserRole `json:"role"`
+	Group  *uint            `json:"group"`
+	Groups *[]uint          `json:"groups"`
+}
+
+type moderationRequest struct {
+	Groups []uint `json:"groups"`
+}
+
+type passwordResetRequest struct {
+	Password string `json:"password"`
+}
+
+type passwordResetResponse struct {
+	Password string `json:"password,omitempty"`
+}
+
+// Users is an admin-only controller used for managing accounts of other users
+type Users struct {
+	Database  *gorm.DB
+	Throttles []*middleware.Throttle
+	// Timetable validates groups and Mailer sends invitations of imported users
+	Timetable *timetable.Coordinator
+	Mailer    mail.Mailer
+}
+
+func (u *Users) Register(router *mux.Router) {
+	router.Handle("/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleGetAll))).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleGetSingle))).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandlePatch))).Methods(http.MethodPatch)
+	router.Handle("/{id:[0-9]+}/deactivate/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleDeactivate))).Methods(http.MethodPost)
+	router.Handle("/{id:[0-9]+}/activate/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleActivate))).Methods(http.MethodPost)
+	router.Handle("/{id:[0-9]+}/password/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleResetPassword))).Methods(http.MethodPost)
+	router.Handle("/{id:[0-9]+}/moderation/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleGetModeration))).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/moderation/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleSetModeration))).Methods(http.MethodPut)
+	router.Handle("/{id:[0-9]+}/sessions/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleGetSessions))).Methods(http.MethodGet)
+	router.Handle("/{id:[0-9]+}/sessions/{session:[0-9]+}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleRevokeSession))).Methods(http.MethodDelete)
+	router.Handle("/{id:[0-9]+}/impersonate/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleImpersonate))).Methods(http.MethodPost)
+	router.Handle("/import/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleImport))).Methods(http.MethodPost)
+	router.Handle("/lockouts/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleGetLockouts))).Methods(http.MethodGet)
+	router.Handle("/lockouts/{key}/", middleware.RequiresAuth(models.RoleAdmin, http.HandlerFunc(u.HandleClearLockout))).Methods(http.MethodDelete)
+}
+
+// load fetches the user specified in the path, it writes an error response and returns nil if it's not possible
+func (u *Users) load(rw http.ResponseWriter, r *http.Request) *models.User {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUserIDInvalid.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return nil
+	}
+
+	user := &models.User{}
+	if res := u.Database.First(user, uint(id)); res.RecordNotFound() {
+		utils.NewErrorResponse(ErrUserNotFound).Write(http.StatusNotFound, rw)
+		return nil
+	} else if res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	user.Password = ""
+	return user
+}
+
+// likeEscaper escapes wildcards of LIKE patterns, so that searches match them literally
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+func (u *Users) HandleGetAll(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	res := u.Database.Order("id")
+
+	if q := query.Get("q"); len(q) > 0 {
+		pattern := "%" + likeEscaper.Replace(q) + "%"
+		res = res.Where("name ILIKE ? OR email ILIKE ?", pattern, pattern)
+	}
+	if group, err := strconv.Atoi(query.Get("group")); err == nil {
+		res = res.Where("\"id\" IN ("+models.GroupMembersQuery+")", group, group)
+	}
+	if role, err := strconv.Atoi(query.Get("role")); err == nil {
+		res = res.Where("role = ?", role)
+	}
+	if deactivated, err := strconv.ParseBool(query.Get("deactivated")); err == nil {
+		res = res.Where("deactivated = ?", deactivated)
+	}
+
+	limit := usersDefaultLimit
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= usersMaximumLimit {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	users := []models.User{}
+	if res := res.Limit(limit).Offset(offset).Find(&users); res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	for i := range users {
+		users[i].Password = ""
+	}
+
+	byt, err := json.Marshal(&users)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+func (u *Users) HandleGetSingle(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+	if err := user.LoadGroups(u.Database); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+func (u *Users) HandlePatch(rw http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	patch := userPatch{}
+	if err := decoder.Decode(&patch); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	before := u.snapshot(u.Database, user.ID)
+	updates := map[string]interface{}{}
+	if patch.Role != nil {
+		if !patch.Role.Valid() {
+			utils.NewErrorResponse(models.ErrUserRoleInvalid).Write(http.StatusBadRequest, rw)
+			return
+		}
+		if user.ID == admin.ID && *patch.Role != user.Role {
+			utils.NewErrorResponse(ErrUserSelfModification).Write(http.StatusBadRequest, rw)
+			return
+		}
+		updates["role"] = *patch.Role
+	}
+	if patch.Group != nil {
+		if !u.groupsExist([]uint{*patch.Group}) {
+			utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusBadRequest, rw)
+			return
+		}
+		updates["group"] = *patch.Group
+	}
+	if patch.Groups != nil && !u.groupsExist(*patch.Groups) {
+		utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	tx := beginAudited(rw, u.Database)
+	if tx == nil {
+		return
+	}
+	if len(updates) > 0 {
+		if res := tx.Model(user).Updates(updates); res.Error != nil {
+			tx.Rollback()
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrUsersUnknown.Error()},
+				DebugErrors: []string{res.Error.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+	}
+	if patch.Groups != nil {
+		if err := user.SetGroups(tx, *patch.Groups); err != nil {
+			tx.Rollback()
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrUsersUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+	}
+	if !audit(rw, r, tx, models.AuditUserUpdate, "user", user.ID, before, u.snapshot(tx, user.ID)) {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// snapshot loads the user with groups for the audit log, it returns nil if that's not possible
+// groupsExist reports whether all the groups are in the timetable directory
+func (u *Users) groupsExist(groups []uint) bool {
+	for _, group := range groups {
+		if u.Timetable == nil || !u.Timetable.GroupExists(group) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *Users) snapshot(db *gorm.DB, id uint) *models.User {
+	user := &models.User{}
+	if res := db.First(user, id); res.Error != nil {
+		return nil
+	}
+	if err := user.LoadGroups(db); err != nil {
+		return nil
+	}
+	user.Password = ""
+	return user
+}
+
+func (u *Users) HandleDeactivate(rw http.ResponseWriter, r *http.Request) {
+	u.setDeactivated(rw, r, true)
+}
+
+func (u *Users) HandleActivate(rw http.ResponseWriter, r *http.Request) {
+	u.setDeactivated(rw, r, false)
+}
+
+func (u *Users) setDeactivated(rw http.ResponseWriter, r *http.Request, deactivated bool) {
+	admin := r.Context().Value(middleware.ContextUserKey).(*models.User)
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+
+	if user.ID == admin.ID {
+		utils.NewErrorResponse(ErrUserSelfModification).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	tx := beginAudited(rw, u.Database)
+	if tx == nil {
+		return
+	}
+	if res := tx.Model(user).Update("deactivated", deactivated); res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	action := models.AuditUserActivate
+	if deactivated {
+		action = models.AuditUserDeactivate
+	}
+	if !audit(rw, r, tx, action, "user", user.ID, nil, nil) {
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// HandleResetPassword sets user's password to the supplied one, a random password is generated and returned if none is given
+func (u *Users) HandleResetPassword(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	req := passwordResetRequest{}
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	resp := passwordResetResponse{}
+	if len(req.Password) == 0 {
+		pwd, err := utils.RandomString(generatedPasswordLength)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{models.ErrUsersUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		req.Password = pwd
+		resp.Password = pwd
+	} else if err := models.ValidatePassword(req.Password); err != nil {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	if err := user.SetPassword(req.Password); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	tx := beginAudited(rw, u.Database)
+	if tx == nil {
+		return
+	}
+	if res := tx.Model(user).Update("password", user.Password); res.Error != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	// snapshots would contain the password hash
+	if !audit(rw, r, tx, models.AuditUserPasswordReset, "user", user.ID, nil, nil) {
+		return
+	}
+
+	byt, _ := json.Marshal(&resp)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleGetModeration lists groups the user moderates
+func (u *Users) HandleGetModeration(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+	u.writeModeration(rw, user)
+}
+
+// HandleSetModeration replaces groups the user moderates, an empty list revokes moderation
+func (u *Users) HandleSetModeration(rw http.ResponseWriter, r *http.Request) {
+	user := u.load(rw, r)
+	if user == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	req := moderationRequest{}
+	if err := decoder.Decode(&req); err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusBadRequest, rw)
+		return
+	}
+	if !u.groupsExist(req.Groups) {
+		utils.NewErrorResponse(ErrUserGroupInvalid).Write(http.StatusBadRequest, rw)
+		return
+	}
+
+	before, err := models.LoadPermissions(u.Database, user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	tx := beginAudited(rw, u.Database)
+	if tx == nil {
+		return
+	}
+	if err := models.SetModeratedGroups(tx, user.ID, req.Groups); err != nil {
+		tx.Rollback()
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	if !audit(rw, r, tx, models.AuditUserModeration, "user", user.ID,
+		&moderationRequest{Groups: before.ModeratedGroups()}, &moderationRequest{Groups: req.Groups}) {
+		return
+	}
+	u.writeModeration(rw, user)
+}
+
+func (u *Users) writeModeration(rw http.ResponseWriter, user *models.User) {
+	perms, err := models.LoadPermissions(u.Database, user)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	byt, err := json.Marshal(&moderationRequest{Groups: perms.ModeratedGroups()})
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// HandleGetLockouts lists throttled login and registration keys
+func (u *Users) HandleGetLockouts(rw http.ResponseWriter, r *http.Request) {
+	lockouts := []middleware.Lockout{}
+	for _, throttle := range u.Throttles {
+		lockouts = append(lockouts, throttle.Lockouts()...)
+	}
+
+	byt, err := json.Marshal(&lockouts)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{models.ErrUsersUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+func (u *Users) HandleClearLockout(rw http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	locked := false
+	for _, throttle := range u.Throttles {
+		for _, lockout := range throttle.Lockouts() {
+			locked = locked || lockout.Key == key
+		}
+	}
+	if !locked {
+		utils.NewErrorResponse(ErrLockoutNotFound).Write(http.StatusNotFound, rw)
+		return
+	}
+	// lockouts are kept in memory, so they are only cleared once the entry is committed
+	tx := beginAudited(rw, u.Database)
+	if tx == nil {
+		return
+	}
+	if !audit(rw, r, tx, models.AuditLockoutClear, "lockout", 0, map[string]string{"key": key}, nil) {
+		return
+	}
+	for _, throttle := range u.Throttles {
+		throttle.Clear(key)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
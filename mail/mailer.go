@@ -0,0 +1,64 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Mailer delivers plain text or html messages to a single recipient
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer builds an SMTP mailer from environment variables, if SMTP_HOST is not set messages are only logged
+func NewMailer(logger *log.Logger) Mailer {
+	if len(os.Getenv("SMTP_HOST")) == 0 {
+		return &LogMailer{Logger: logger}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if len(port) == 0 {
+		port = "587"
+	}
+	return &SMTPMailer{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if len(m.Username) > 0 {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	contentType := "text/plain"
+	if strings.HasPrefix(strings.TrimSpace(body), "<") {
+		contentType = "text/html"
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: %s; charset=UTF-8\r\n\r\n%s", m.From, to, mime.QEncoding.Encode("utf-8", subject), contentType, body)
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, []byte(msg))
+}
+
+// LogMailer is used in development, it writes messages to the log instead of sending them
+type LogMailer struct {
+	Logger *log.Logger
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	m.Logger.Printf("mail to %s, subject: %s\n%s\n", to, subject, body)
+	return nil
+}
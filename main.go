@@ -7,6 +7,7 @@ import (
 	"log"
 
 	"os"
+	"strings"
 
 	"net/http"
 
@@ -18,7 +19,10 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/maciekmm/uek-bruschetta/channels"
 	"github.com/maciekmm/uek-bruschetta/controllers"
+	"github.com/maciekmm/uek-bruschetta/mail"
+	"github.com/maciekmm/uek-bruschetta/middleware"
 	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/oidc"
 	"github.com/maciekmm/uek-bruschetta/timetable"
 )
 
@@ -26,6 +30,16 @@ func main() {
 	logger := log.New(os.Stdout, "Bruschette", log.Ldate|log.Lshortfile)
 	app := &Application{Logger: logger}
 
+	if len(os.Args) > 1 {
+		if err := app.initDatabase(); err != nil {
+			logger.Fatal(err)
+		}
+		if err := app.runCommand(os.Args[1:]); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
 	err := app.init()
 	if err != nil {
 		logger.Fatal(err)
@@ -41,58 +55,41 @@ type Application struct {
 	Database           *gorm.DB
 	Logger             *log.Logger
 	ChannelCoordinator *channels.Coordinator
+	Mailer             mail.Mailer
 	router             *mux.Router
 }
 
 func (a *Application) init() error {
 	a.Logger.Println("starting Bruschette")
 
-	a.Logger.Println("setting up database connection")
-	con, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@database/%s?sslmode=disable", os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD"), os.Getenv("POSTGRES_DB")))
-	if err != nil {
-		return fmt.Errorf("could not open database connection: %s", err.Error())
-	}
-
-	a.Logger.Println("establishing database connection")
-	deadline := time.After(10 * time.Second)
-out:
-	for {
-		select {
-		case <-deadline:
-			return fmt.Errorf("could not establish database connection, last error: %s", err.Error())
-		default:
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			defer cancel()
-			err = con.PingContext(ctx)
-			if err == nil {
-				break out
-			} else {
-				a.Logger.Printf("pinging database failed: %s\n", err.Error())
-			}
-			time.Sleep(1 * time.Second)
-		}
-	}
-	// auto-migrating models
-	a.Database, err = gorm.Open("postgres", con)
-	a.Database.SetLogger(a.Logger)
-	if err != nil {
+	if err := a.initDatabase(); err != nil {
 		return err
 	}
 
-	a.Database.AutoMigrate(&models.User{}, &models.Event{}, &models.Interaction{}, &models.Subscription{})
+	a.Mailer = mail.NewMailer(a.Logger)
 
 	// setup channel coordinator
 	messenger := &channels.Messenger{
 		Logger:   a.Logger,
 		Database: a.Database,
 	}
-	a.ChannelCoordinator = channels.NewCoordinator(a.Logger, a.Database, messenger)
+	email := &channels.Email{Mailer: a.Mailer, Database: a.Database}
+	a.ChannelCoordinator = channels.NewCoordinator(a.Logger, a.Database, messenger, email)
 	go a.ChannelCoordinator.Start()
 
 	// setup timetables
 	timetable := timetable.NewCoordinator(2*time.Hour, a.Database, a.Logger, a.ChannelCoordinator)
 	go timetable.Start()
 
+	// setup daily and weekly digests
+	digests := &channels.Digests{
+		Database:  a.Database,
+		Timetable: timetable,
+		Channels:  a.ChannelCoordinator,
+		Logger:    a.Logger,
+	}
+	go digests.Start()
+
 	// setup routes
 	a.Logger.Println("setting up routes")
 	a.router = mux.NewRouter()
@@ -103,9 +100,51 @@ out:
 	})
 
 	// accounts
-	accountController := &controllers.Accounts{Database: a.Database}
+	accountThrottle := middleware.NewThrottle(5, 30*time.Second, time.Hour, time.Hour)
+	ipThrottle := middleware.NewThrottle(50, 30*time.Second, time.Hour, time.Hour)
+	accountController := &controllers.Accounts{
+		Database:        a.Database,
+		Timetable:       timetable,
+		Mailer:          a.Mailer,
+		AccountThrottle: accountThrottle,
+		IPThrottle:      ipThrottle,
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); len(issuer) > 0 {
+		redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if len(redirectURL) == 0 {
+			redirectURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/") + "/accounts/oidc/callback/"
+		}
+		accountController.OpenID = oidc.NewProvider(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL)
+		accountController.OpenIDLogins = oidc.NewPendingLogins(10 * time.Minute)
+		go accountController.OpenIDLogins.Start()
+	}
 	accountController.Register(a.router.PathPrefix("/accounts/").Subrouter())
 
+	// users
+	usersController := &controllers.Users{
+		Database:  a.Database,
+		Throttles: []*middleware.Throttle{accountThrottle, ipThrottle},
+		Timetable: timetable,
+		Mailer:    a.Mailer,
+	}
+	usersController.Register(a.router.PathPrefix("/users/").Subrouter())
+
+	// invitations
+	invitationsController := &controllers.Invitations{Database: a.Database, Timetable: timetable}
+	invitationsController.Register(a.router.PathPrefix("/invitations/").Subrouter())
+
+	// api keys
+	apiKeysController := &controllers.APIKeys{Database: a.Database}
+	apiKeysController.Register(a.router.PathPrefix("/apikeys/").Subrouter())
+
+	// calendar feeds
+	calendarController := &controllers.Calendar{Database: a.Database, Timetable: timetable}
+	calendarController.Register(a.router.PathPrefix("/calendar/").Subrouter())
+
+	// audit log
+	auditController := &controllers.Audit{Database: a.Database}
+	auditController.Register(a.router.PathPrefix("/audit/").Subrouter())
+
 	// events
 	eventsController := &controllers.Events{Database: a.Database, Coordinator: a.ChannelCoordinator}
 	eventsController.Register(a.router.PathPrefix("/events/").Subrouter())
@@ -124,6 +163,44 @@ out:
 	return nil
 }
 
+func (a *Application) initDatabase() error {
+	a.Logger.Println("setting up database connection")
+	con, err := sql.Open("postgres", fmt.Sprintf("postgres://%s:%s@database/%s?sslmode=disable", os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD"), os.Getenv("POSTGRES_DB")))
+	if err != nil {
+		return fmt.Errorf("could not open database connection: %s", err.Error())
+	}
+
+	a.Logger.Println("establishing database connection")
+	deadline := time.After(10 * time.Second)
+out:
+	for {
+		select {
+		case <-deadline:
+			return fmt.Errorf("could not establish database connection, last error: %s", err.Error())
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			err = con.PingContext(ctx)
+			if err == nil {
+				break out
+			} else {
+				a.Logger.Printf("pinging database failed: %s\n", err.Error())
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
+	// auto-migrating models
+	a.Database, err = gorm.Open("postgres", con)
+	a.Database.SetLogger(a.Logger)
+	if err != nil {
+		return err
+	}
+
+	a.Database.AutoMigrate(&models.User{}, &models.Event{}, &models.Interaction{}, &models.Subscription{}, &models.RecoveryCode{}, &models.APIKey{}, &models.GroupModerator{}, &models.Invitation{}, &models.Membership{}, &models.Session{}, &models.AuditEntry{}, &models.FeedToken{}, &models.TimetableSnapshot{}, &models.TimetableChange{}, &models.ClassSelection{})
+	middleware.Database = a.Database
+	return nil
+}
+
 func (a *Application) serve() error {
 	server := http.Server{
 		Addr:           ":3000",
@@ -5,29 +5,49 @@ import (
 	"errors"
 	"net/http"
 	"os"
-
+	"strconv"
 	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
 	"github.com/maciekmm/uek-bruschetta/models"
 	"github.com/maciekmm/uek-bruschetta/utils"
 )
 
 var (
-	ErrAuthInvalidToken = errors.New("invalid token")
-	ErrAuthNoPermission = errors.New("inferior user-role")
-	ErrAuthUnknown      = errors.New("unknown error")
+	ErrAuthInvalidToken     = errors.New("invalid token")
+	ErrAuthNoPermission     = errors.New("inferior user-role")
+	ErrAuthUnknown          = errors.New("unknown error")
+	ErrAuthDeactivated      = errors.New("account deactivated")
+	ErrAuthTwoFactor        = errors.New("two-factor authentication required")
+	ErrAuthAPIKeyNotAllowed = errors.New("api keys are not accepted by this endpoint")
+	ErrAuthSessionRevoked   = errors.New("session expired or revoked")
+	ErrAuthReadOnly         = errors.New("impersonation tokens are read-only")
 )
 
+// Database is used to reload the token's user on every request, so that role changes and deactivations apply immediately.
+// Tokens are trusted as-is if it's not set.
+var Database *gorm.DB
+
 type ContextKey string
 
 const (
-	ContextUserKey ContextKey = "user"
+	ContextUserKey        ContextKey = "user"
+	ContextAPIKeyKey      ContextKey = "api_key"
+	ContextMFAKey         ContextKey = "mfa"
+	ContextPermissionsKey ContextKey = "permissions"
+	ContextSessionKey     ContextKey = "session"
+	// ContextImpersonatorKey holds the id of the admin acting as the user, it's only set for impersonation tokens
+	ContextImpersonatorKey ContextKey = "impersonator"
 )
 
 type AuthClaims struct {
 	jwt.StandardClaims
 	User *models.User
+	// MFA is set if the token was issued after verifying a second factor
+	MFA bool `json:"mfa,omitempty"`
+	// Impersonator is the admin acting as User, such tokens belong to the admin's session and are read-only
+	Impersonator uint `json:"impersonator,omitempty"`
 }
 
 func ParseToken(req *http.Request) (*jwt.Token, *AuthClaims, error) {
@@ -41,13 +61,24 @@ func ParseToken(req *http.Request) (*jwt.Token, *AuthClaims, error) {
 	if err != nil {
 		return tok, nil, err
 	} else if claims, ok := tok.Claims.(*AuthClaims); ok {
+		// tokens with an audience are issued for a single purpose, e.g. finishing a two-factor login
+		if len(claims.Audience) > 0 || claims.User == nil {
+			return tok, nil, ErrAuthInvalidToken
+		}
 		return tok, claims, err
 	}
 	return tok, nil, err
 }
 
-func RequiresAuth(role models.UserRole, h http.Handler) http.Handler {
+// RequiresAuth lets through requests authenticated as a user with at least the given role.
+// API keys are only accepted if scopes are listed and the key was granted all of them, they act as the admin who created them.
+func RequiresAuth(role models.UserRole, h http.Handler, scopes ...models.APIKeyScope) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if raw := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(raw, models.APIKeyPrefix) {
+			authenticateAPIKey(rw, req, raw, role, h, scopes)
+			return
+		}
+
 		tok, claims, err := ParseToken(req)
 
 		if err != nil || !tok.Valid {
@@ -55,8 +86,52 @@ func RequiresAuth(role models.UserRole, h http.Handler) http.Handler {
 			return
 		}
 
+		var session *models.Session
+		if claims != nil && claims.User != nil && Database != nil {
+			user := loadUser(rw, claims.User.ID)
+			if user == nil {
+				return
+			}
+			claims.User = user
+
+			if claims.Impersonator != 0 {
+				if admin := loadUser(rw, claims.Impersonator); admin == nil {
+					return
+				} else if admin.Role < models.RoleAdmin {
+					utils.NewErrorResponse(ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
+					return
+				}
+			}
+
+			if session = LoadSession(rw, claims); session == nil {
+				return
+			}
+			// this is just for bookkeeping, we don't care if it fails
+			go session.Touch(Database, utils.ClientIP(req))
+		}
+
+		if claims != nil && claims.Impersonator != 0 {
+			rw.Header().Set("X-Impersonated-By", strconv.Itoa(int(claims.Impersonator)))
+			if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodOptions {
+				utils.NewErrorResponse(ErrAuthReadOnly).Write(http.StatusForbidden, rw)
+				return
+			}
+		}
+
+		if claims != nil && role >= models.RoleAdmin && claims.User.TwoFactorRequired() && !claims.MFA {
+			utils.NewErrorResponse(ErrAuthTwoFactor).Write(http.StatusUnauthorized, rw)
+			return
+		}
+
 		if claims != nil && claims.User.Role >= role {
 			ctx := context.WithValue(req.Context(), ContextUserKey, claims.User)
+			ctx = context.WithValue(ctx, ContextMFAKey, claims.MFA)
+			if session != nil {
+				ctx = context.WithValue(ctx, ContextSessionKey, session)
+			}
+			if claims.Impersonator != 0 {
+				ctx = context.WithValue(ctx, ContextImpersonatorKey, claims.Impersonator)
+			}
 			h.ServeHTTP(rw, req.WithContext(ctx))
 		} else if claims != nil && claims.User.Role < role {
 			utils.NewErrorResponse(ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
@@ -65,3 +140,124 @@ func RequiresAuth(role models.UserRole, h http.Handler) http.Handler {
 		}
 	})
 }
+
+// RequiresModerator lets through admins and users moderating at least one group, their permissions are put in the context.
+// Handlers still have to check whether the user manages the group of the particular event.
+func RequiresModerator(h http.Handler, scopes ...models.APIKeyScope) http.Handler {
+	return RequiresAuth(models.RoleUser, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user := req.Context().Value(ContextUserKey).(*models.User)
+		if Database == nil {
+			utils.NewErrorResponse(ErrAuthUnknown).Write(http.StatusInternalServerError, rw)
+			return
+		}
+		perms, err := models.LoadPermissions(Database, user)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrAuthUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return
+		}
+
+		// admins acting with a password-only token are held to the same two-factor policy as on admin endpoints
+		_, viaKey := req.Context().Value(ContextAPIKeyKey).(*models.APIKey)
+		mfa, _ := req.Context().Value(ContextMFAKey).(bool)
+		if perms.Admin && !viaKey && user.TwoFactorRequired() && !mfa {
+			utils.NewErrorResponse(ErrAuthTwoFactor).Write(http.StatusUnauthorized, rw)
+			return
+		}
+
+		if !perms.IsModerator() {
+			utils.NewErrorResponse(ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
+			return
+		}
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), ContextPermissionsKey, perms)))
+	}), scopes...)
+}
+
+func authenticateAPIKey(rw http.ResponseWriter, req *http.Request, raw string, role models.UserRole, h http.Handler, scopes []models.APIKeyScope) {
+	if Database == nil || len(scopes) == 0 {
+		utils.NewErrorResponse(ErrAuthAPIKeyNotAllowed).Write(http.StatusUnauthorized, rw)
+		return
+	}
+
+	key, err := models.AuthenticateAPIKey(Database, raw)
+	if err == models.ErrAPIKeyInvalid || err == models.ErrAPIKeyExpired {
+		utils.NewErrorResponse(err).Write(http.StatusUnauthorized, rw)
+		return
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAuthUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+
+	for _, scope := range scopes {
+		if !key.HasScope(scope) {
+			utils.NewErrorResponse(ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
+			return
+		}
+	}
+
+	user := loadUser(rw, key.UserID)
+	if user == nil {
+		return
+	}
+	if user.Role < role {
+		utils.NewErrorResponse(ErrAuthNoPermission).Write(http.StatusUnauthorized, rw)
+		return
+	}
+
+	// this is just for bookkeeping, we don't care if it fails
+	go key.Touch(Database, utils.ClientIP(req))
+
+	ctx := context.WithValue(req.Context(), ContextUserKey, user)
+	ctx = context.WithValue(ctx, ContextAPIKeyKey, key)
+	h.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+// LoadSession fetches the session the token belongs to, it writes an error response and returns nil if it was revoked
+func LoadSession(rw http.ResponseWriter, claims *AuthClaims) *models.Session {
+	if len(claims.Id) == 0 {
+		utils.NewErrorResponse(ErrAuthSessionRevoked).Write(http.StatusUnauthorized, rw)
+		return nil
+	}
+	owner := claims.User.ID
+	if claims.Impersonator != 0 {
+		owner = claims.Impersonator
+	}
+	session, err := models.FindSession(Database, claims.Id)
+	if err == models.ErrSessionNotFound || (err == nil && session.UserID != owner) {
+		utils.NewErrorResponse(ErrAuthSessionRevoked).Write(http.StatusUnauthorized, rw)
+		return nil
+	} else if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAuthUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	return session
+}
+
+// loadUser fetches the current state of the user, it writes an error response and returns nil if the user can't be authenticated
+func loadUser(rw http.ResponseWriter, id uint) *models.User {
+	user := &models.User{}
+	if res := Database.First(user, id); res.RecordNotFound() {
+		utils.NewErrorResponse(ErrAuthInvalidToken).Write(http.StatusUnauthorized, rw)
+		return nil
+	} else if res.Error != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrAuthUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return nil
+	}
+	if user.Deactivated {
+		utils.NewErrorResponse(ErrAuthDeactivated).Write(http.StatusUnauthorized, rw)
+		return nil
+	}
+	user.Password = ""
+	return user
+}
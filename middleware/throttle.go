@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// throttleSweepSize is the number of tracked keys after which stale entries are swept on every failure
+const throttleSweepSize = 1 << 12
+
+// Lockout describes the state of a throttled key
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Throttle counts failed attempts per key, once Threshold is exceeded the key is locked out
+// for BaseDelay doubling with every further failure up to MaxDelay. Failures are forgotten after Window of inactivity.
+type Throttle struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+	// Now is the clock used by the throttle, it can be replaced in tests
+	Now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*Lockout
+}
+
+func NewThrottle(threshold int, baseDelay, maxDelay, window time.Duration) *Throttle {
+	return &Throttle{
+		Threshold: threshold,
+		BaseDelay: baseDelay,
+		MaxDelay:  maxDelay,
+		Window:    window,
+		Now:       time.Now,
+		entries:   make(map[string]*Lockout),
+	}
+}
+
+// Allowed reports whether none of the keys is locked out, if one is it returns the time left until it's unlocked
+func (t *Throttle) Allowed(keys ...string) (bool, time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.Now()
+	wait := time.Duration(0)
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if left := entry.LockedUntil.Sub(now); left > wait {
+			wait = left
+		}
+	}
+	return wait == 0, wait
+}
+
+// Fail registers a failed attempt for every key
+func (t *Throttle) Fail(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.Now()
+	if len(t.entries) > throttleSweepSize {
+		t.sweep(now)
+	}
+	for _, key := range keys {
+		entry, ok := t.entries[key]
+		if !ok || t.expired(entry, now) {
+			entry = &Lockout{Key: key}
+			t.entries[key] = entry
+		}
+		entry.Failures++
+		entry.LastFailure = now
+		if over := entry.Failures - t.Threshold; over > 0 {
+			entry.LockedUntil = now.Add(t.delay(over))
+		}
+	}
+}
+
+// Succeed forgets failures of the keys
+func (t *Throttle) Succeed(keys ...string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, key := range keys {
+		delete(t.entries, key)
+	}
+}
+
+// Lockouts returns all keys with recent failures, sorted by key
+func (t *Throttle) Lockouts() []Lockout {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sweep(t.Now())
+	lockouts := []Lockout{}
+	for _, entry := range t.entries {
+		lockouts = append(lockouts, *entry)
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].Key < lockouts[j].Key
+	})
+	return lockouts
+}
+
+// Clear removes the key, it returns false if the key wasn't tracked
+func (t *Throttle) Clear(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+	return ok
+}
+
+func (t *Throttle) delay(over int) time.Duration {
+	delay := t.BaseDelay
+	for i := 1; i < over && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+	return delay
+}
+
+func (t *Throttle) expired(entry *Lockout, now time.Time) bool {
+	return now.After(entry.LockedUntil) && now.Sub(entry.LastFailure) > t.Window
+}
+
+func (t *Throttle) sweep(now time.Time) {
+	for key, entry := range t.entries {
+		if t.expired(entry, now) {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestThrottle(now *time.Time) *Throttle {
+	throttle := NewThrottle(3, 30*time.Second, 5*time.Minute, time.Hour)
+	throttle.Now = func() time.Time { return *now }
+	return throttle
+}
+
+func TestThrottleLockout(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	throttle := newTestThrottle(&now)
+
+	for i := 0; i < 3; i++ {
+		throttle.Fail("ip:1")
+		if ok, _ := throttle.Allowed("ip:1"); !ok {
+			t.Fatalf("locked out after %d failures, threshold is 3", i+1)
+		}
+	}
+	throttle.Fail("ip:1")
+	ok, wait := throttle.Allowed("ip:1")
+	if ok || wait != 30*time.Second {
+		t.Fatalf("expected a 30s lockout after exceeding the threshold, got allowed %t, wait %s", ok, wait)
+	}
+	if ok, _ := throttle.Allowed("ip:2"); !ok {
+		t.Error("other keys are locked out as well")
+	}
+	if ok, _ := throttle.Allowed("ip:2", "ip:1"); ok {
+		t.Error("locked out key is allowed alongside another one")
+	}
+
+	now = now.Add(10 * time.Second)
+	if _, wait := throttle.Allowed("ip:1"); wait != 20*time.Second {
+		t.Errorf("expected 20s left of the lockout, got %s", wait)
+	}
+	now = now.Add(20 * time.Second)
+	if ok, _ := throttle.Allowed("ip:1"); !ok {
+		t.Error("key is still locked out after the delay")
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	throttle := newTestThrottle(&now)
+	for i := 0; i < 3; i++ {
+		throttle.Fail("account:a")
+	}
+
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, delay := range expected {
+		throttle.Fail("account:a")
+		if _, wait := throttle.Allowed("account:a"); wait != delay {
+			t.Errorf("failure %d over the threshold locks out for %s, expected %s", i+1, wait, delay)
+		}
+		now = now.Add(delay)
+	}
+}
+
+func TestThrottleWindow(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	throttle := newTestThrottle(&now)
+	for i := 0; i < 4; i++ {
+		throttle.Fail("ip:1")
+	}
+
+	// failures are forgotten after the window has passed since the last one
+	now = now.Add(time.Hour + time.Second)
+	throttle.Fail("ip:1")
+	if ok, _ := throttle.Allowed("ip:1"); !ok {
+		t.Fatal("failures from before the window still count")
+	}
+	if lockouts := throttle.Lockouts(); len(lockouts) != 1 || lockouts[0].Failures != 1 {
+		t.Fatalf("expected a single failure to be tracked, got %+v", lockouts)
+	}
+}
+
+func TestThrottleSucceedAndClear(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	throttle := newTestThrottle(&now)
+	for i := 0; i < 4; i++ {
+		throttle.Fail("ip:1", "account:a")
+	}
+
+	throttle.Succeed("account:a")
+	if ok, _ := throttle.Allowed("account:a"); !ok {
+		t.Error("key is locked out after a success")
+	}
+	if !throttle.Clear("ip:1") {
+		t.Error("clearing a locked out key reported it wasn't tracked")
+	}
+	if ok, _ := throttle.Allowed("ip:1"); !ok {
+		t.Error("key is locked out after being cleared")
+	}
+	if throttle.Clear("ip:1") {
+		t.Error("clearing an untracked key reported it was tracked")
+	}
+	if lockouts := throttle.Lockouts(); len(lockouts) != 0 {
+		t.Errorf("expected no lockouts, got %+v", lockouts)
+	}
+}
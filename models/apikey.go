@@ -0,0 +1,145 @@
+package models
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+type APIKeyScope string
+
+const (
+	ScopeEventsWrite   APIKeyScope = "events:write"
+	ScopeEventsRead    APIKeyScope = "events:read"
+	ScopeAnalyticsRead APIKeyScope = "analytics:read"
+)
+
+// APIKeyPrefix marks bearer tokens which are API keys rather than JWTs
+const APIKeyPrefix = "bk_"
+
+const (
+	apiKeyIDLength     = 6
+	apiKeySecretLength = 24
+)
+
+var (
+	ErrAPIKeysUnknown      = errors.New("unknown error")
+	ErrAPIKeyIDInvalid     = errors.New("invalid api key id")
+	ErrAPIKeyNotFound      = errors.New("api key not found")
+	ErrAPIKeyNameInvalid   = errors.New("invalid name")
+	ErrAPIKeyScopeInvalid  = errors.New("invalid scope")
+	ErrAPIKeyInvalid       = errors.New("invalid api key")
+	ErrAPIKeyExpired       = errors.New("api key expired")
+	ErrAPIKeyExpiryInvalid = errors.New("expiry has to be in the future")
+)
+
+var validScopes = map[APIKeyScope]bool{
+	ScopeEventsWrite:   true,
+	ScopeEventsRead:    true,
+	ScopeAnalyticsRead: true,
+}
+
+// APIKey lets external services call the API on behalf of the admin who created it, limited to its scopes.
+// Only a hash of the secret part is stored, deleting the key revokes it.
+type APIKey struct {
+	gorm.Model
+	Name       string         `json:"name,omitempty"`
+	Prefix     string         `json:"prefix,omitempty" gorm:"unique_index"`
+	Hash       string         `json:"-"`
+	Scopes     pq.StringArray `json:"scopes" gorm:"type:text[]"`
+	UserID     uint           `json:"user_id,omitempty"`
+	ExpiresAt  *time.Time     `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time     `json:"last_used_at,omitempty"`
+	LastUsedIP string         `json:"last_used_ip,omitempty"`
+}
+
+// HasScope reports whether the key was granted the scope
+func (k *APIKey) HasScope(scope APIKeyScope) bool {
+	for _, s := range k.Scopes {
+		if APIKeyScope(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Add validates and stores the key, it returns the full key which is never retrievable again
+func (k *APIKey) Add(db *gorm.DB) (string, error) {
+	errs := []error{}
+	if len(strings.TrimSpace(k.Name)) == 0 {
+		errs = append(errs, ErrAPIKeyNameInvalid)
+	}
+	if len(k.Scopes) == 0 {
+		errs = append(errs, ErrAPIKeyScopeInvalid)
+	}
+	for _, scope := range k.Scopes {
+		if !validScopes[APIKeyScope(scope)] {
+			errs = append(errs, ErrAPIKeyScopeInvalid)
+			break
+		}
+	}
+	if k.ExpiresAt != nil && k.ExpiresAt.Before(time.Now()) {
+		errs = append(errs, ErrAPIKeyExpiryInvalid)
+	}
+	if len(errs) > 0 {
+		return "", utils.NewErrorResponse(errs...)
+	}
+
+	prefix, err := utils.RandomString(apiKeyIDLength)
+	if err != nil {
+		return "", err
+	}
+	secret, err := utils.RandomString(apiKeySecretLength)
+	if err != nil {
+		return "", err
+	}
+	k.Prefix = strings.Replace(prefix, "_", "-", -1)
+	k.Hash = utils.HashToken(secret)
+	k.LastUsedAt = nil
+	k.LastUsedIP = ""
+
+	if res := db.Create(k); res.Error != nil {
+		return "", &utils.ErrorResponse{
+			Errors:      []string{ErrAPIKeysUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}
+	}
+	return APIKeyPrefix + k.Prefix + "_" + secret, nil
+}
+
+// AuthenticateAPIKey looks up the key and verifies its secret and expiry
+func AuthenticateAPIKey(db *gorm.DB, raw string) (*APIKey, error) {
+	fragments := strings.SplitN(strings.TrimPrefix(raw, APIKeyPrefix), "_", 2)
+	if !strings.HasPrefix(raw, APIKeyPrefix) || len(fragments) != 2 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	key := &APIKey{}
+	if res := db.First(key, "prefix = ?", fragments[0]); res.RecordNotFound() {
+		return nil, ErrAPIKeyInvalid
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(utils.HashToken(fragments[1]))) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+	return key, nil
+}
+
+// Touch records the use of the key
+func (k *APIKey) Touch(db *gorm.DB, ip string) error {
+	now := time.Now()
+	return db.Model(k).UpdateColumns(map[string]interface{}{
+		"last_used_at": &now,
+		"last_used_ip": ip,
+	}).Error
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type AuditAction string
+
+const (
+	AuditImpersonationStarted AuditAction = "impersonation.start"
+
+	AuditEventCreate  AuditAction = "event.create"
+	AuditEventUpdate  AuditAction = "event.update"
+	AuditEventReplace AuditAction = "event.replace"
+	AuditEventDelete  AuditAction = "event.delete"
+
+	AuditUserUpdate        AuditAction = "user.update"
+	AuditUserDeactivate    AuditAction = "user.deactivate"
+	AuditUserActivate      AuditAction = "user.activate"
+	AuditUserPasswordReset AuditAction = "user.password_reset"
+	AuditUserModeration    AuditAction = "user.moderation"
+	AuditUserImport        AuditAction = "user.import"
+	AuditSessionRevoke     AuditAction = "session.revoke"
+	AuditLockoutClear      AuditAction = "lockout.clear"
+
+	AuditInvitationCreate AuditAction = "invitation.create"
+	AuditInvitationRevoke AuditAction = "invitation.revoke"
+	AuditAPIKeyCreate     AuditAction = "apikey.create"
+	AuditAPIKeyRevoke     AuditAction = "apikey.revoke"
+
+	AuditSubscriptionCreate AuditAction = "subscription.create"
+	AuditSubscriptionUpdate AuditAction = "subscription.update"
+	AuditSubscriptionDelete AuditAction = "subscription.delete"
+)
+
+var (
+	ErrAuditUnknown = errors.New("unknown error")
+	ErrAuditFailed  = errors.New("could not record the action in the audit log, it was not performed")
+)
+
+// AuditSnapshot is a json document of the target's state, it's embedded as is in responses
+type AuditSnapshot string
+
+func (s AuditSnapshot) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return []byte("null"), nil
+	}
+	return []byte(s), nil
+}
+
+// AuditEntry records a privileged action, entries are never modified or deleted
+type AuditEntry struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+	ActorID   uint      `json:"actor_id" gorm:"index"`
+	// APIKeyID is set if the actor acted through an API key
+	APIKeyID   *uint         `json:"api_key_id,omitempty"`
+	IP         string        `json:"ip,omitempty"`
+	Action     AuditAction   `json:"action" gorm:"index"`
+	TargetType string        `json:"target_type,omitempty"`
+	TargetID   uint          `json:"target_id,omitempty" gorm:"index"`
+	Before     AuditSnapshot `json:"before" gorm:"type:text"`
+	After      AuditSnapshot `json:"after" gorm:"type:text"`
+	Details    string        `json:"details,omitempty" gorm:"type:text"`
+}
+
+// Add stores the entry along with json snapshots of the target before and after the action, nil snapshots are skipped
+func (e *AuditEntry) Add(db *gorm.DB, before, after interface{}) error {
+	for _, snapshot := range []struct {
+		value interface{}
+		field *AuditSnapshot
+	}{{before, &e.Before}, {after, &e.After}} {
+		if snapshot.value == nil {
+			continue
+		}
+		byt, err := json.Marshal(snapshot.value)
+		if err != nil {
+			return err
+		}
+		*snapshot.field = AuditSnapshot(byt)
+	}
+	e.ID = 0
+	return db.Create(e).Error
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	ErrClassSelectionsUnknown = errors.New("unknown error")
+	ErrClassSelectionInvalid  = errors.New("selected classes need a subject")
+)
+
+// ClassSelection marks classes the user attends, an empty type or teacher matches any.
+// Users without selections are considered to attend all classes of their groups.
+type ClassSelection struct {
+	ID      uint   `json:"-"`
+	UserID  uint   `json:"-" gorm:"index"`
+	Subject string `json:"subject"`
+	Type    string `json:"type,omitempty"`
+	Teacher string `json:"teacher,omitempty"`
+}
+
+// Matches reports whether the class is covered by the selection, ignoring case and surrounding whitespace
+func (s *ClassSelection) Matches(subject, classType, teacher string) bool {
+	return equalFold(s.Subject, subject) &&
+		(len(s.Type) == 0 || equalFold(s.Type, classType)) &&
+		(len(s.Teacher) == 0 || equalFold(s.Teacher, teacher))
+}
+
+// UserClassSelections lists classes selected by the user
+func UserClassSelections(db *gorm.DB, userID uint) ([]ClassSelection, error) {
+	selections := []ClassSelection{}
+	res := db.Where("user_id = ?", userID).Order("subject").Find(&selections)
+	return selections, res.Error
+}
+
+// GroupClassSelections loads selections of the users keyed by user id
+func GroupClassSelections(db *gorm.DB, userIDs []uint) (map[uint][]ClassSelection, error) {
+	byUser := map[uint][]ClassSelection{}
+	if len(userIDs) == 0 {
+		return byUser, nil
+	}
+	selections := []ClassSelection{}
+	if res := db.Where("user_id IN (?)", userIDs).Find(&selections); res.Error != nil {
+		return nil, res.Error
+	}
+	for _, selection := range selections {
+		byUser[selection.UserID] = append(byUser[selection.UserID], selection)
+	}
+	return byUser, nil
+}
+
+// SetClassSelections replaces classes selected by the user, an empty list means the user attends all classes
+func SetClassSelections(db *gorm.DB, userID uint, selections []ClassSelection) error {
+	for i := range selections {
+		selections[i].Subject = strings.TrimSpace(selections[i].Subject)
+		selections[i].Type = strings.TrimSpace(selections[i].Type)
+		selections[i].Teacher = strings.TrimSpace(selections[i].Teacher)
+		if len(selections[i].Subject) == 0 {
+			return ErrClassSelectionInvalid
+		}
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if res := tx.Where("user_id = ?", userID).Delete(&ClassSelection{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	for i := range selections {
+		selections[i].ID = 0
+		selections[i].UserID = userID
+		if res := tx.Create(&selections[i]); res.Error != nil {
+			tx.Rollback()
+			return res.Error
+		}
+	}
+	return tx.Commit().Error
+}
+
+// GroupMembers lists active users belonging to the group either as their home group or an additional one
+func GroupMembers(db *gorm.DB, group uint) ([]User, error) {
+	users := []User{}
+	res := db.Where("\"id\" IN ("+GroupMembersQuery+") AND deactivated = ?", group, group, false).Find(&users)
+	return users, res.Error
+}
+
+func equalFold(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
@@ -0,0 +1,138 @@
+package models
+
+// commonPasswords are the most frequent passwords found in public breach compilations, including popular Polish ones.
+// They are compared in lower case.
+var commonPasswords = map[string]bool{
+	"000000":        true,
+	"00000000":      true,
+	"1111":          true,
+	"111111":        true,
+	"11111111":      true,
+	"112233":        true,
+	"121212":        true,
+	"123123":        true,
+	"123123123":     true,
+	"1234":          true,
+	"12345":         true,
+	"123456":        true,
+	"1234567":       true,
+	"12345678":      true,
+	"123456789":     true,
+	"1234567890":    true,
+	"123321":        true,
+	"123abc":        true,
+	"123qwe":        true,
+	"1q2w3e":        true,
+	"1q2w3e4r":      true,
+	"1q2w3e4r5t":    true,
+	"1qaz2wsx":      true,
+	"654321":        true,
+	"666666":        true,
+	"696969":        true,
+	"7777777":       true,
+	"87654321":      true,
+	"88888888":      true,
+	"987654321":     true,
+	"999999":        true,
+	"aaaaaa":        true,
+	"abc123":        true,
+	"abcd1234":      true,
+	"abcdef":        true,
+	"access":        true,
+	"admin":         true,
+	"admin123":      true,
+	"administrator": true,
+	"agnieszka":     true,
+	"asdasd":        true,
+	"asdf1234":      true,
+	"asdfgh":        true,
+	"asdfghjk":      true,
+	"asdfghjkl":     true,
+	"ashley":        true,
+	"azerty":        true,
+	"bailey":        true,
+	"baseball":      true,
+	"batman":        true,
+	"biedronka":     true,
+	"buster":        true,
+	"changeme":      true,
+	"charlie":       true,
+	"cheese":        true,
+	"chocolate":     true,
+	"computer":      true,
+	"dragon":        true,
+	"dupa":          true,
+	"dupa123":       true,
+	"dupadupa":      true,
+	"football":      true,
+	"freedom":       true,
+	"google":        true,
+	"haslo":         true,
+	"haslo1":        true,
+	"haslo123":      true,
+	"hello":         true,
+	"hello123":      true,
+	"iloveyou":      true,
+	"jordan":        true,
+	"kacper":        true,
+	"kasia":         true,
+	"kasia1":        true,
+	"killer":        true,
+	"kochanie":      true,
+	"kochamcie":     true,
+	"krakow":        true,
+	"letmein":       true,
+	"lolek":         true,
+	"lolek123":      true,
+	"love":          true,
+	"lovely":        true,
+	"marcin":        true,
+	"master":        true,
+	"matrix":        true,
+	"michael":       true,
+	"michal":        true,
+	"misiek":        true,
+	"monika":        true,
+	"monkey":        true,
+	"mustang":       true,
+	"myszka":        true,
+	"nicole":        true,
+	"niunia":        true,
+	"paskuda":       true,
+	"passw0rd":      true,
+	"password":      true,
+	"password1":     true,
+	"password123":   true,
+	"pokemon":       true,
+	"polska":        true,
+	"polska1":       true,
+	"polska12":      true,
+	"polska123":     true,
+	"princess":      true,
+	"qazwsx":        true,
+	"qwe123":        true,
+	"qwer1234":      true,
+	"qwerty":        true,
+	"qwerty1":       true,
+	"qwerty12":      true,
+	"qwerty123":     true,
+	"qwertyuiop":    true,
+	"samsung":       true,
+	"shadow":        true,
+	"słoneczko":     true,
+	"sloneczko":     true,
+	"soccer":        true,
+	"starwars":      true,
+	"sunshine":      true,
+	"superman":      true,
+	"trustno1":      true,
+	"uek":           true,
+	"uekkrakow":     true,
+	"welcome":       true,
+	"whatever":      true,
+	"zaq1@wsx":      true,
+	"zaq12wsx":      true,
+	"zaq1xsw2":      true,
+	"zxcvbn":        true,
+	"zxcvbnm":       true,
+}
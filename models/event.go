@@ -1,9 +1,13 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/maciekmm/uek-bruschetta/utils"
 )
 
@@ -18,11 +22,57 @@ const (
 var (
 	ErrEventsUnknown                   = errors.New("unknown error")
 	ErrEventIDInvalid                  = errors.New("invalid id")
+	ErrEventNotFound                   = errors.New("event not found")
 	ErrEventDescriptionInvalid         = errors.New("invalid description")
 	ErrEventNameInvalid                = errors.New("invalid name")
 	ErrEventNotificationMessageInvalid = errors.New("invalid notification message")
+	ErrEventDatesInvalid               = errors.New("event has to start before it ends")
 )
 
+type EventPayloadKind string
+
+const (
+	// EventPayloadTimetableChange payloads list changes of a group's timetable
+	EventPayloadTimetableChange EventPayloadKind = "timetable_change"
+	// EventPayloadTimetableDigest payloads list classes of a day or a week sent as a digest
+	EventPayloadTimetableDigest EventPayloadKind = "timetable_digest"
+	// EventPayloadClassReminder payloads hold the upcoming class a user is reminded of
+	EventPayloadClassReminder EventPayloadKind = "class_reminder"
+)
+
+// UnlistedEventPayloads are kinds of events sent to a single user at a time,
+// they are stored so that links in messages lead to them but are left out of event listings
+var UnlistedEventPayloads = []EventPayloadKind{EventPayloadClassReminder, EventPayloadTimetableDigest}
+
+// EventPayload is structured content generated along with the event, clients and channels render it if they know the kind.
+// It's stored as a json column.
+type EventPayload struct {
+	Kind EventPayloadKind `json:"kind"`
+	// Changes are timetable.ClassDiff records, they are kept raw as models can't depend on the timetable package
+	Changes json.RawMessage `json:"changes,omitempty"`
+	// Classes are timetable.Class records
+	Classes json.RawMessage `json:"classes,omitempty"`
+}
+
+func (p *EventPayload) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	return json.Marshal(p)
+}
+
+func (p *EventPayload) Scan(src interface{}) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, p)
+	case string:
+		return json.Unmarshal([]byte(data), p)
+	}
+	return errors.New("unsupported event payload type")
+}
+
 type EventPipe interface {
 	Send(*Event) error
 }
@@ -36,9 +86,35 @@ type Event struct {
 	NotificationMessage string         `json:"message,omitempty"`
 	Priority            *EventPriority `json:"priority,omitempty"`
 	Group               *uint          `json:"group,omitempty"`
+	// StartsAt is optional, events with a start are included in calendar feeds
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	Location string     `json:"location,omitempty"`
+	// Payload is generated by the server, it's ignored in requests
+	Payload *EventPayload `json:"payload,omitempty" gorm:"type:jsonb"`
+	// Users narrow the audience down to these members of the group, it's generated by the server and never serialized
+	// so that recipients aren't disclosed to each other
+	Users pq.Int64Array `json:"-" gorm:"type:integer[]"`
+}
+
+// DatesValid reports whether the event ends after it starts, an end without a start is invalid
+func (event *Event) DatesValid() bool {
+	if event.EndsAt == nil {
+		return true
+	}
+	return event.StartsAt != nil && event.EndsAt.After(*event.StartsAt)
 }
 
+// Add stores the event and sends notifications about it
 func (event *Event) Add(db *gorm.DB, coord EventPipe) error {
+	if err := event.Store(db); err != nil {
+		return err
+	}
+	return event.Notify(coord)
+}
+
+// Store validates and stores the event without sending notifications, e.g. before its transaction is committed
+func (event *Event) Store(db *gorm.DB) error {
 	errs := []error{}
 	if len(event.Description) == 0 {
 		errs = append(errs, ErrEventDescriptionInvalid)
@@ -48,7 +124,10 @@ func (event *Event) Add(db *gorm.DB, coord EventPipe) error {
 	}
 	if len(event.NotificationMessage) == 0 {
 		errs = append(errs, ErrEventNotificationMessageInvalid)
-	} 
+	}
+	if !event.DatesValid() {
+		errs = append(errs, ErrEventDatesInvalid)
+	}
 
 	if len(errs) > 0 {
 		return utils.NewErrorResponse(errs...)
@@ -74,6 +153,11 @@ func (event *Event) Add(db *gorm.DB, coord EventPipe) error {
 		}
 	}
 
+	return nil
+}
+
+// Notify sends notifications about a stored event
+func (event *Event) Notify(coord EventPipe) error {
 	// verify completeness of provided model
 	if err := coord.Send(event); err != nil {
 		return (&utils.ErrorResponse{
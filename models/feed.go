@@ -0,0 +1,96 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const feedTokenLength = 24
+
+var (
+	ErrFeedsUnknown     = errors.New("unknown error")
+	ErrFeedTokenInvalid = errors.New("invalid feed token")
+	ErrFeedTokenMissing = errors.New("no feed token issued")
+)
+
+// FeedToken lets calendar apps fetch the user's calendar without a JWT, a user has at most one.
+// Only a hash of the token is stored, deleting it revokes the feed.
+type FeedToken struct {
+	ID         uint       `json:"-"`
+	UserID     uint       `json:"-" gorm:"unique_index"`
+	Hash       string     `json:"-" gorm:"unique_index"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IssueFeedToken replaces the user's feed token with a new one, it returns the token which is never retrievable again
+func IssueFeedToken(db *gorm.DB, userID uint) (*FeedToken, string, error) {
+	token, err := utils.RandomString(feedTokenLength)
+	if err != nil {
+		return nil, "", err
+	}
+	feed := &FeedToken{UserID: userID, Hash: utils.HashToken(token)}
+
+	tx := db.Begin()
+	if res := tx.Where("user_id = ?", userID).Delete(&FeedToken{}); res.Error != nil {
+		tx.Rollback()
+		return nil, "", res.Error
+	}
+	if res := tx.Create(feed); res.Error != nil {
+		tx.Rollback()
+		return nil, "", res.Error
+	}
+	return feed, token, tx.Commit().Error
+}
+
+// UserFeedToken returns metadata of the user's feed token
+func UserFeedToken(db *gorm.DB, userID uint) (*FeedToken, error) {
+	feed := &FeedToken{}
+	if res := db.First(feed, "user_id = ?", userID); res.RecordNotFound() {
+		return nil, ErrFeedTokenMissing
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+	return feed, nil
+}
+
+// RevokeFeedToken removes the user's feed token, calendar apps subscribed to it stop receiving updates
+func RevokeFeedToken(db *gorm.DB, userID uint) error {
+	res := db.Where("user_id = ?", userID).Delete(&FeedToken{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrFeedTokenMissing
+	}
+	return nil
+}
+
+// FindFeedUser looks up the active user the feed token belongs to
+func FindFeedUser(db *gorm.DB, token string) (*User, error) {
+	feed := &FeedToken{}
+	if res := db.First(feed, "hash = ?", utils.HashToken(token)); res.RecordNotFound() {
+		return nil, ErrFeedTokenInvalid
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+
+	user := &User{}
+	if res := db.First(user, feed.UserID); res.RecordNotFound() {
+		return nil, ErrFeedTokenInvalid
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+	if user.Deactivated {
+		return nil, ErrFeedTokenInvalid
+	}
+	user.Password = ""
+
+	// this is just for bookkeeping, calendar apps poll often
+	now := time.Now()
+	db.Model(feed).UpdateColumn("last_used_at", now)
+	return user, nil
+}
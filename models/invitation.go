@@ -0,0 +1,147 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	invitationTokenLength     = 24
+	invitationDefaultLifetime = 7 * 24 * time.Hour
+	invitationMaximumLifetime = 90 * 24 * time.Hour
+)
+
+var (
+	ErrInvitationsUnknown       = errors.New("unknown error")
+	ErrInvitationIDInvalid      = errors.New("invalid invitation id")
+	ErrInvitationInvalid        = errors.New("invitation invalid, expired or used up")
+	ErrInvitationEmailMismatch  = errors.New("invitation was issued for a different email")
+	ErrInvitationExpiryInvalid  = errors.New("expiry has to be in the future and within 90 days")
+	ErrInvitationMaxUsesInvalid = errors.New("max uses can't be negative")
+)
+
+// Invitation lets people register with a preset role, group and moderated groups.
+// Only a hash of the token is stored, deleting the invitation revokes it.
+type Invitation struct {
+	gorm.Model
+	TokenHash string `json:"-" gorm:"unique_index"`
+	// Email restricts the invitation to a single address if set
+	Email     string        `json:"email,omitempty"`
+	Role      UserRole      `json:"role"`
+	Group     *uint         `json:"group,omitempty"`
+	Moderates pq.Int64Array `json:"moderates" gorm:"type:integer[]"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+	// MaxUses of 0 means the invitation can be used until it expires
+	MaxUses     int  `json:"max_uses"`
+	Uses        int  `json:"uses"`
+	CreatedByID uint `json:"created_by,omitempty"`
+}
+
+// Add validates and stores the invitation, it returns the token which is never retrievable again
+func (inv *Invitation) Add(db *gorm.DB) (string, error) {
+	now := time.Now()
+	if inv.ExpiresAt == nil {
+		expiry := now.Add(invitationDefaultLifetime)
+		inv.ExpiresAt = &expiry
+	}
+
+	errs := []error{}
+	if !inv.Role.Valid() {
+		errs = append(errs, ErrUserRoleInvalid)
+	}
+	if inv.ExpiresAt.Before(now) || inv.ExpiresAt.After(now.Add(invitationMaximumLifetime)) {
+		errs = append(errs, ErrInvitationExpiryInvalid)
+	}
+	if inv.MaxUses < 0 {
+		errs = append(errs, ErrInvitationMaxUsesInvalid)
+	}
+	if len(errs) > 0 {
+		return "", utils.NewErrorResponse(errs...)
+	}
+
+	token, err := utils.RandomString(invitationTokenLength)
+	if err != nil {
+		return "", err
+	}
+	inv.TokenHash = utils.HashToken(token)
+	inv.Email = strings.TrimSpace(inv.Email)
+	inv.Uses = 0
+	if inv.Moderates == nil {
+		inv.Moderates = pq.Int64Array{}
+	}
+
+	if res := db.Create(inv); res.Error != nil {
+		return "", &utils.ErrorResponse{
+			Errors:      []string{ErrInvitationsUnknown.Error()},
+			DebugErrors: []string{res.Error.Error()},
+		}
+	}
+	return token, nil
+}
+
+// ModeratedGroups returns groups the invited user will moderate
+func (inv *Invitation) ModeratedGroups() []uint {
+	groups := []uint{}
+	for _, group := range inv.Moderates {
+		groups = append(groups, uint(group))
+	}
+	return groups
+}
+
+// FindInvitation looks up a usable invitation by its token
+func FindInvitation(db *gorm.DB, token string) (*Invitation, error) {
+	inv := &Invitation{}
+	if res := db.First(inv, "token_hash = ?", utils.HashToken(token)); res.RecordNotFound() {
+		return nil, ErrInvitationInvalid
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+	if (inv.ExpiresAt != nil && inv.ExpiresAt.Before(time.Now())) || (inv.MaxUses > 0 && inv.Uses >= inv.MaxUses) {
+		return nil, ErrInvitationInvalid
+	}
+	return inv, nil
+}
+
+// Redeem creates the user with the invitation's role, group and moderator grants and counts the use.
+// The user's password has to be already set, nothing is stored if any step fails.
+func (inv *Invitation) Redeem(db *gorm.DB, user *User) error {
+	if len(inv.Email) > 0 && !strings.EqualFold(inv.Email, user.Email) {
+		return ErrInvitationEmailMismatch
+	}
+	user.Role = inv.Role
+	if inv.Group != nil {
+		user.Group = inv.Group
+	}
+	user.Deactivated = false
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// the conditions are checked again here so that concurrent registrations can't exceed max uses
+	res := tx.Model(&Invitation{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)", inv.ID, time.Now()).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrInvitationInvalid
+	}
+	if res := tx.Create(user); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if err := grantModeration(tx, user.ID, inv.ModeratedGroups()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
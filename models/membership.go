@@ -0,0 +1,96 @@
+package models
+
+import (
+	"sort"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Membership adds a group besides user's home group, e.g. for language lectures, electives or specialisations
+type Membership struct {
+	ID     uint `json:"-"`
+	UserID uint `json:"user_id" gorm:"index"`
+	Group  uint `json:"group" gorm:"index"`
+}
+
+// LoadGroups fills Groups with user's additional groups in ascending order
+func (u *User) LoadGroups(db *gorm.DB) error {
+	memberships := []Membership{}
+	if res := db.Where("user_id = ?", u.ID).Order("\"group\"").Find(&memberships); res.Error != nil {
+		return res.Error
+	}
+	u.Groups = []uint{}
+	for _, membership := range memberships {
+		u.Groups = append(u.Groups, membership.Group)
+	}
+	return nil
+}
+
+// AllGroups returns the home group followed by additional groups, LoadGroups has to be called first
+func (u *User) AllGroups() []uint {
+	groups := []uint{}
+	if u.Group != nil {
+		groups = append(groups, *u.Group)
+	}
+	for _, group := range u.Groups {
+		if u.Group == nil || group != *u.Group {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// SetGroups replaces user's additional groups, the home group is never stored as one
+func (u *User) SetGroups(db *gorm.DB, groups []uint) error {
+	stored := []uint{}
+	err := transaction(db, func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", u.ID).Delete(&Membership{}); res.Error != nil {
+			return res.Error
+		}
+
+		seen := map[uint]bool{}
+		if u.Group != nil {
+			seen[*u.Group] = true
+		}
+		for _, group := range groups {
+			if seen[group] {
+				continue
+			}
+			seen[group] = true
+			if res := tx.Create(&Membership{UserID: u.ID, Group: group}); res.Error != nil {
+				return res.Error
+			}
+			stored = append(stored, group)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i] < stored[j]
+	})
+	u.Groups = stored
+	return nil
+}
+
+// GroupMembersQuery is a subquery of ids of users belonging to the group either as their home group or an additional one
+const GroupMembersQuery = "SELECT \"id\" FROM \"users\" WHERE \"group\" = ? UNION SELECT \"user_id\" FROM \"memberships\" WHERE \"group\" = ?"
+
+// ActiveGroups lists every group at least one user belongs to
+func ActiveGroups(db *gorm.DB) ([]uint, error) {
+	groups := []uint{}
+	rows, err := db.Raw("SELECT \"group\" FROM \"users\" WHERE \"group\" IS NOT NULL UNION SELECT \"group\" FROM \"memberships\" ORDER BY 1").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group uint
+		if err := rows.Scan(&group); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	// bcrypt ignores everything past 72 bytes
+	passwordMaxLength = 72
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password is too short")
+	ErrPasswordTooLong  = errors.New("password is too long")
+	ErrPasswordCommon   = errors.New("password is too common")
+)
+
+// PasswordMinLength is read from PASSWORD_MIN_LENGTH, it defaults to 8 characters
+func PasswordMinLength() int {
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && length > 0 {
+		return length
+	}
+	return defaultPasswordMinLength
+}
+
+// ValidatePassword checks the password against the policy: minimum length and the bundled list of common breached passwords
+func ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < PasswordMinLength() {
+		return ErrPasswordTooShort
+	}
+	if len(password) > passwordMaxLength {
+		return ErrPasswordTooLong
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		return ErrPasswordCommon
+	}
+	return nil
+}
+
+// passwordCost is read from BCRYPT_COST, it defaults to bcrypt.DefaultCost
+func passwordCost() int {
+	if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+		return cost
+	}
+	return bcrypt.DefaultCost
+}
+
+// PasswordNeedsRehash reports whether the stored hash was made with a different cost than the configured one
+func (u *User) PasswordNeedsRehash() bool {
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	return err == nil && cost != passwordCost()
+}
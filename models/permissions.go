@@ -0,0 +1,89 @@
+package models
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+)
+
+var ErrPermissionDenied = errors.New("you don't manage this group")
+
+// GroupModerator grants a user the right to manage events targeting a single group
+type GroupModerator struct {
+	ID     uint `json:"-"`
+	UserID uint `json:"user_id" gorm:"index"`
+	Group  uint `json:"group"`
+}
+
+// Permissions describes which events a user can manage, admins manage all of them
+type Permissions struct {
+	Admin  bool
+	Groups map[uint]bool
+}
+
+// LoadPermissions gathers user's role and moderator grants
+func LoadPermissions(db *gorm.DB, user *User) (*Permissions, error) {
+	perms := &Permissions{
+		Admin:  user.Role >= RoleAdmin,
+		Groups: map[uint]bool{},
+	}
+	grants := []GroupModerator{}
+	if res := db.Where("user_id = ?", user.ID).Find(&grants); res.Error != nil {
+		return nil, res.Error
+	}
+	for _, grant := range grants {
+		perms.Groups[grant.Group] = true
+	}
+	return perms, nil
+}
+
+// IsModerator reports whether the user can manage any events at all
+func (p *Permissions) IsModerator() bool {
+	return p.Admin || len(p.Groups) > 0
+}
+
+// CanManage reports whether the user can manage events targeting the group, events without a group are global and admin-only
+func (p *Permissions) CanManage(group *uint) bool {
+	if p.Admin {
+		return true
+	}
+	return group != nil && p.Groups[*group]
+}
+
+// ModeratedGroups returns groups the user was granted moderation of in ascending order
+func (p *Permissions) ModeratedGroups() []uint {
+	groups := []uint{}
+	for group := range p.Groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i] < groups[j]
+	})
+	return groups
+}
+
+// SetModeratedGroups replaces user's moderator grants
+func SetModeratedGroups(db *gorm.DB, userID uint, groups []uint) error {
+	return transaction(db, func(tx *gorm.DB) error {
+		if res := tx.Where("user_id = ?", userID).Delete(&GroupModerator{}); res.Error != nil {
+			return res.Error
+		}
+		return grantModeration(tx, userID, groups)
+	})
+}
+
+// grantModeration adds moderator grants, it's meant to be run inside a transaction
+func grantModeration(tx *gorm.DB, userID uint, groups []uint) error {
+	seen := map[uint]bool{}
+	for _, group := range groups {
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		if res := tx.Create(&GroupModerator{UserID: userID, Group: group}); res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 8
+)
+
+// RecoveryCode is a single-use code which replaces a TOTP code if the authenticator is lost
+type RecoveryCode struct {
+	ID     uint       `json:"id,omitempty"`
+	UserID uint       `json:"user_id,omitempty" gorm:"index"`
+	Hash   string     `json:"-"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// GenerateRecoveryCodes replaces all user's recovery codes with new ones and returns them in plain text
+func GenerateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := []string{}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if res := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}); res.Error != nil {
+		tx.Rollback()
+		return nil, res.Error
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.RandomString(recoveryCodeLength)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		code = strings.ToLower(code)
+		if res := tx.Create(&RecoveryCode{UserID: userID, Hash: utils.HashToken(code)}); res.Error != nil {
+			tx.Rollback()
+			return nil, res.Error
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit().Error
+}
+
+// UseRecoveryCode marks the code as used, it returns false if the code is unknown or was already used
+func UseRecoveryCode(db *gorm.DB, userID uint, code string) (bool, error) {
+	now := time.Now()
+	res := db.Model(&RecoveryCode{}).Where("user_id = ? AND hash = ? AND used_at IS NULL", userID, utils.HashToken(strings.ToLower(strings.TrimSpace(code)))).Update("used_at", &now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
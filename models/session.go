@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	sessionFamilyLength = 24
+	// SessionIdleLifetime is how long a session can go unused before it stops being refreshable
+	SessionIdleLifetime = 30 * 24 * time.Hour
+	// sessionTouchInterval limits how often last use is written
+	sessionTouchInterval = time.Minute
+)
+
+var (
+	ErrSessionsUnknown  = errors.New("unknown error")
+	ErrSessionIDInvalid = errors.New("invalid session id")
+	ErrSessionNotFound  = errors.New("session not found")
+)
+
+// Session tracks a token family, i.e. a token issued on login and all tokens refreshed from it.
+// Deleting the session revokes every token of the family.
+type Session struct {
+	ID         uint      `json:"id"`
+	Family     string    `json:"-" gorm:"unique_index"`
+	UserID     uint      `json:"user_id" gorm:"index"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+	// Current marks the session of the requesting token
+	Current bool `json:"current" gorm:"-"`
+}
+
+// StartSession creates a new token family for the user, sessions idle for too long are cleaned up on the way
+func StartSession(db *gorm.DB, userID uint, userAgent, ip string) (*Session, error) {
+	family, err := utils.RandomString(sessionFamilyLength)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &Session{
+		Family:     family,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		LastUsedAt: now,
+		LastUsedIP: ip,
+	}
+	if res := db.Where("user_id = ? AND last_used_at < ?", userID, now.Add(-SessionIdleLifetime)).Delete(&Session{}); res.Error != nil {
+		return nil, res.Error
+	}
+	if res := db.Create(session); res.Error != nil {
+		return nil, res.Error
+	}
+	return session, nil
+}
+
+// FindSession looks up an active session of the token family
+func FindSession(db *gorm.DB, family string) (*Session, error) {
+	session := &Session{}
+	if res := db.First(session, "family = ? AND last_used_at >= ?", family, time.Now().Add(-SessionIdleLifetime)); res.RecordNotFound() {
+		return nil, ErrSessionNotFound
+	} else if res.Error != nil {
+		return nil, res.Error
+	}
+	return session, nil
+}
+
+// UserSessions lists active sessions of the user, most recently used first
+func UserSessions(db *gorm.DB, userID uint) ([]Session, error) {
+	sessions := []Session{}
+	res := db.Where("user_id = ? AND last_used_at >= ?", userID, time.Now().Add(-SessionIdleLifetime)).Order("last_used_at DESC").Find(&sessions)
+	return sessions, res.Error
+}
+
+// RevokeSession deletes user's session, it returns ErrSessionNotFound if there was none
+func RevokeSession(db *gorm.DB, userID, id uint) error {
+	res := db.Where("id = ? AND user_id = ?", id, userID).Delete(&Session{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Touch records the use of the session, writes are skipped if it was used very recently from the same address
+func (s *Session) Touch(db *gorm.DB, ip string) error {
+	now := time.Now()
+	if now.Sub(s.LastUsedAt) < sessionTouchInterval && s.LastUsedIP == ip {
+		return nil
+	}
+	return db.Model(s).UpdateColumns(map[string]interface{}{
+		"last_used_at": now,
+		"last_used_ip": ip,
+	}).Error
+}
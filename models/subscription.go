@@ -2,26 +2,109 @@ package models
 
 import (
 	"errors"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/maciekmm/uek-bruschetta/utils"
 )
 
 type ChannelType string
 
+// DigestKind selects which overview of classes is sent through the subscription
+type DigestKind string
+
+const (
+	DigestNone DigestKind = "none"
+	// DigestDaily lists classes of the day it's sent on
+	DigestDaily DigestKind = "daily"
+	// DigestWeekly lists classes of the seven days following the day it's sent on
+	DigestWeekly DigestKind = "weekly"
+)
+
+// DigestTimeFormat is the format of digest times, they are wall clock times in Europe/Warsaw
+const DigestTimeFormat = "15:04"
+
 var (
-	ErrSubscriptionsUnknown         = errors.New("unknown error")
-	ErrSubscriptionChannelInvalid   = errors.New("invalid channel")
-	ErrSubscriptionChannelIDInvalid = errors.New("invalid channel id")
-	ErrSubscriptionIDInvalid        = errors.New("invalid subscription id")
+	ErrSubscriptionsUnknown          = errors.New("unknown error")
+	ErrSubscriptionChannelInvalid    = errors.New("invalid channel")
+	ErrSubscriptionChannelIDInvalid  = errors.New("invalid channel id")
+	ErrSubscriptionIDInvalid         = errors.New("invalid subscription id")
+	ErrSubscriptionEmailInvalid      = errors.New("email subscriptions have to use the account's email")
+	ErrSubscriptionDigestInvalid     = errors.New("invalid digest, it has to be none, daily or weekly")
+	ErrSubscriptionDigestTimeInvalid = errors.New("invalid digest time, it has to be formatted as HH:MM")
+	ErrSubscriptionDigestDaysInvalid = errors.New("invalid digest days, they have to be between 0 (Sunday) and 6 (Saturday)")
 )
 
+// digestDefaults are the time and days digests are sent at unless the subscription specifies them
+var digestDefaults = map[DigestKind]struct {
+	time string
+	days []time.Weekday
+}{
+	DigestDaily:  {"07:00", []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}},
+	DigestWeekly: {"20:00", []time.Weekday{time.Sunday}},
+}
+
 type Subscription struct {
 	gorm.Model
 	UserID          uint           `json:"user_id,omitempty"`
 	MinimumPriority *EventPriority `json:"priority" gorm:"default:0"`
 	Channel         ChannelType    `json:"channel,omitempty"`
 	ChannelID       string         `json:"channel_id,omitempty"`
+	// Digest overviews of classes are sent at DigestTime on DigestDays (0 is Sunday) regardless of MinimumPriority,
+	// daily digests default to 07:00 on weekdays and weekly ones to 20:00 on Sundays
+	Digest     DigestKind    `json:"digest,omitempty" gorm:"default:'none'"`
+	DigestTime string        `json:"digest_time,omitempty"`
+	DigestDays pq.Int64Array `json:"digest_days,omitempty" gorm:"type:integer[]"`
+}
+
+// ValidateDigest checks digest preferences, unset fields are valid as they are either kept or defaulted
+func (s *Subscription) ValidateDigest() []error {
+	errors := []error{}
+	if _, ok := digestDefaults[s.Digest]; !ok && len(s.Digest) > 0 && s.Digest != DigestNone {
+		errors = append(errors, ErrSubscriptionDigestInvalid)
+	}
+	if len(s.DigestTime) > 0 {
+		if _, err := time.Parse(DigestTimeFormat, s.DigestTime); err != nil {
+			errors = append(errors, ErrSubscriptionDigestTimeInvalid)
+		}
+	}
+	for _, day := range s.DigestDays {
+		if day < int64(time.Sunday) || day > int64(time.Saturday) {
+			errors = append(errors, ErrSubscriptionDigestDaysInvalid)
+			break
+		}
+	}
+	return errors
+}
+
+// DigestDue reports whether the digest is due at the wall clock time, which is truncated to minutes
+func (s *Subscription) DigestDue(at time.Time) bool {
+	defaults, ok := digestDefaults[s.Digest]
+	if !ok {
+		return false
+	}
+	digestTime := s.DigestTime
+	if len(digestTime) == 0 {
+		digestTime = defaults.time
+	}
+	if at.Format(DigestTimeFormat) != digestTime {
+		return false
+	}
+	if len(s.DigestDays) == 0 {
+		for _, day := range defaults.days {
+			if at.Weekday() == day {
+				return true
+			}
+		}
+		return false
+	}
+	for _, day := range s.DigestDays {
+		if at.Weekday() == time.Weekday(day) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Subscription) Add(db *gorm.DB) error {
@@ -33,6 +116,10 @@ func (s *Subscription) Add(db *gorm.DB) error {
 	if len(s.ChannelID) == 0 {
 		errors = append(errors, ErrSubscriptionChannelIDInvalid)
 	}
+	errors = append(errors, s.ValidateDigest()...)
+	if len(s.Digest) == 0 {
+		s.Digest = DigestNone
+	}
 
 	if len(errors) > 0 {
 		return utils.NewErrorResponse(errors...)
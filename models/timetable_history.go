@@ -0,0 +1,87 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const timetableChangesLimit = 1000
+
+var ErrTimetableHistoryUnknown = errors.New("unknown error")
+
+// TimetableSnapshot is a version of a group's timetable, a new version is stored every time changes are detected
+type TimetableSnapshot struct {
+	ID        uint            `json:"-"`
+	Group     uint            `json:"group" gorm:"index"`
+	Period    uint            `json:"period"`
+	Version   uint            `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Classes   json.RawMessage `json:"classes" gorm:"type:jsonb"`
+}
+
+// TimetableChange is a change of a single class between two versions of the timetable, Old or New is null if the class was added or cancelled.
+// They are pointers as only a nil pointer is stored as SQL NULL, an empty json.RawMessage would be sent as an invalid empty jsonb value.
+type TimetableChange struct {
+	ID         uint             `json:"id"`
+	SnapshotID uint             `json:"-" gorm:"index"`
+	Group      uint             `json:"group" gorm:"index"`
+	Period     uint             `json:"period"`
+	Version    uint             `json:"version"`
+	CreatedAt  time.Time        `json:"created_at" gorm:"index"`
+	Kind       string           `json:"kind"`
+	Old        *json.RawMessage `json:"old" gorm:"type:jsonb"`
+	New        *json.RawMessage `json:"new" gorm:"type:jsonb"`
+}
+
+// HasTimetableSnapshot reports whether any version of the group's timetable is stored
+func HasTimetableSnapshot(db *gorm.DB, group, period uint) (bool, error) {
+	count := 0
+	res := db.Model(&TimetableSnapshot{}).Where("\"group\" = ? AND period = ?", group, period).Count(&count)
+	return count > 0, res.Error
+}
+
+// RecordTimetableVersion stores the timetable as the next version along with changes since the previous one
+func RecordTimetableVersion(db *gorm.DB, snapshot *TimetableSnapshot, changes []TimetableChange) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	latest := TimetableSnapshot{}
+	res := tx.Select("version").Where("\"group\" = ? AND period = ?", snapshot.Group, snapshot.Period).Order("version DESC").First(&latest)
+	if res.Error != nil && !res.RecordNotFound() {
+		tx.Rollback()
+		return res.Error
+	}
+	snapshot.ID = 0
+	snapshot.Version = latest.Version + 1
+	if res := tx.Create(snapshot); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		change.ID = 0
+		change.SnapshotID = snapshot.ID
+		change.Group = snapshot.Group
+		change.Period = snapshot.Period
+		change.Version = snapshot.Version
+		change.CreatedAt = snapshot.CreatedAt
+		if res := tx.Create(change); res.Error != nil {
+			tx.Rollback()
+			return res.Error
+		}
+	}
+	return tx.Commit().Error
+}
+
+// TimetableChanges lists changes of the group's timetable detected since the time, oldest first
+func TimetableChanges(db *gorm.DB, group, period uint, since time.Time) ([]TimetableChange, error) {
+	changes := []TimetableChange{}
+	res := db.Where("\"group\" = ? AND period = ? AND created_at >= ?", group, period, since).Order("id").Limit(timetableChangesLimit).Find(&changes)
+	return changes, res.Error
+}
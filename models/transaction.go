@@ -0,0 +1,24 @@
+package models
+
+import (
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
+
+// transaction runs fn in a new transaction, or in the caller's one if db is a transaction already,
+// so that changes can be committed together with e.g. their audit log entry
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return fn(db)
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
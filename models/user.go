@@ -1,7 +1,12 @@
 package models
 
 import (
+	"errors"
+	"os"
+	"time"
+
 	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UserRole int
@@ -11,11 +16,186 @@ const (
 	RoleAdmin
 )
 
+// MaximumReminderMinutes limits the reminder lead time to a day
+const MaximumReminderMinutes = 24 * 60
+
+var (
+	ErrUsersUnknown    = errors.New("unknown error")
+	ErrUserIDInvalid   = errors.New("invalid user id")
+	ErrUserRoleInvalid = errors.New("invalid role")
+)
+
 type User struct {
 	gorm.Model
-	Name     string   `json:"name,omitempty"`
-	Email    string   `json:"email" gorm:"index"`
-	Role     UserRole `json:"role" gorm:"default:0"`
-	Password string   `json:"password,omitempty"`
-	Group    *uint     `json:"group,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Email       string   `json:"email" gorm:"index"`
+	Role        UserRole `json:"role" gorm:"default:0"`
+	Password    string   `json:"password,omitempty"`
+	Group       *uint    `json:"group,omitempty"`
+	Deactivated bool     `json:"deactivated,omitempty" gorm:"default:false"`
+	// Groups are additional groups the user attends classes with, they are stored as memberships and filled by LoadGroups
+	Groups []uint `json:"groups,omitempty" gorm:"-"`
+	// MuteUnselectedChanges silences timetable changes of classes the user didn't select, otherwise they're sent at low priority
+	MuteUnselectedChanges bool `json:"mute_unselected_changes" gorm:"default:false"`
+	// ReminderMinutes is how long before each class the user is reminded of it, 0 disables reminders
+	ReminderMinutes uint `json:"reminder_minutes" gorm:"default:0"`
+	// PendingEmail is applied once the owner proves access to it with EmailToken
+	PendingEmail        string     `json:"pending_email,omitempty"`
+	EmailToken          string     `json:"-" gorm:"index"`
+	EmailTokenExpiresAt *time.Time `json:"-"`
+	// TOTPSecret is set on enrolment, but only used for logging in once TOTPEnabled is set
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled" gorm:"default:false"`
+	TOTPLastStep int64  `json:"-"`
+	// OpenIDSubject links the account to an identity at the configured OpenID Connect issuer
+	OpenIDSubject string `json:"-" gorm:"index"`
+}
+
+// ReminderRecipients lists active users who opted in to class reminders, their groups are loaded
+func ReminderRecipients(db *gorm.DB) ([]User, error) {
+	users := []User{}
+	if res := db.Where("reminder_minutes > 0 AND deactivated = ?", false).Find(&users); res.Error != nil {
+		return nil, res.Error
+	}
+	for i := range users {
+		if err := users[i].LoadGroups(db); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// TwoFactorRequired reports whether the policy requires the user to log in with a second factor, it's mandatory
+// for admins unless ADMIN_2FA_REQUIRED is set to FALSE
+func (u *User) TwoFactorRequired() bool {
+	return u.Role >= RoleAdmin && os.Getenv("ADMIN_2FA_REQUIRED") != "FALSE"
+}
+
+func (r UserRole) Valid() bool {
+	return r == RoleUser || r == RoleAdmin
+}
+
+// SetPassword replaces user's password with a bcrypt hash of the supplied one, the policy is checked by ValidatePassword
+func (u *User) SetPassword(password string) error {
+	pwd, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost())
+	if err != nil {
+		return err
+	}
+	u.Password = string(pwd)
+	return nil
+}
+
+// HasPassword reports whether a password is set, accounts created through the identity provider or imported as pending have none
+func (u *User) HasPassword() bool {
+	return len(u.Password) > 0
+}
+
+// CheckPassword reports whether the supplied password matches the stored hash
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+// UserExport holds all the personal data stored about a user
+type UserExport struct {
+	User          User             `json:"user"`
+	Subscriptions []Subscription   `json:"subscriptions"`
+	Interactions  []Interaction    `json:"interactions"`
+	Events        []Event          `json:"events"`
+	Moderates     []uint           `json:"moderates"`
+	Sessions      []Session        `json:"sessions"`
+	Classes       []ClassSelection `json:"classes"`
+}
+
+// Export gathers user's data from all models, including soft-deleted rows
+func (u *User) Export(db *gorm.DB) (*UserExport, error) {
+	export := &UserExport{
+		Subscriptions: []Subscription{},
+		Interactions:  []Interaction{},
+		Events:        []Event{},
+		Sessions:      []Session{},
+	}
+	if res := db.Unscoped().First(&export.User, u.ID); res.Error != nil {
+		return nil, res.Error
+	}
+	export.User.Password = ""
+	export.User.EmailToken = ""
+	export.User.TOTPSecret = ""
+	if err := export.User.LoadGroups(db); err != nil {
+		return nil, err
+	}
+
+	if res := db.Unscoped().Where("user_id = ?", u.ID).Find(&export.Subscriptions); res.Error != nil {
+		return nil, res.Error
+	}
+	if res := db.Unscoped().Where("user_id = ?", u.ID).Find(&export.Interactions); res.Error != nil {
+		return nil, res.Error
+	}
+	if res := db.Unscoped().Where("user_id = ?", u.ID).Find(&export.Events); res.Error != nil {
+		return nil, res.Error
+	}
+	perms, err := LoadPermissions(db, u)
+	if err != nil {
+		return nil, err
+	}
+	export.Moderates = perms.ModeratedGroups()
+	if res := db.Where("user_id = ?", u.ID).Find(&export.Sessions); res.Error != nil {
+		return nil, res.Error
+	}
+	if export.Classes, err = UserClassSelections(db, u.ID); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// Forget hard-deletes the user along with their subscriptions, interactions and credentials, events they authored are kept but anonymised
+func (u *User) Forget(db *gorm.DB) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if res := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&Subscription{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&Interaction{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Unscoped().Where("user_id = ?", u.ID).Delete(&APIKey{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&GroupModerator{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&Membership{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&Session{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&FeedToken{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Where("user_id = ?", u.ID).Delete(&ClassSelection{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Unscoped().Model(&Event{}).Where("user_id = ?", u.ID).UpdateColumn("user_id", 0); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res := tx.Unscoped().Where("id = ?", u.ID).Delete(&User{}); res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	return tx.Commit().Error
 }
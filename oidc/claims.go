@@ -0,0 +1,67 @@
+package oidc
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// audience may be encoded either as a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(byt []byte) error {
+	var single string
+	if err := json.Unmarshal(byt, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(byt, &multiple); err != nil {
+		return err
+	}
+	*a = audience(multiple)
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// stringBool accepts booleans sent as strings, some providers encode email_verified that way
+type stringBool bool
+
+func (b *stringBool) UnmarshalJSON(byt []byte) error {
+	var value bool
+	if err := json.Unmarshal(byt, &value); err == nil {
+		*b = stringBool(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(byt, &str); err != nil {
+		return err
+	}
+	value, err := strconv.ParseBool(str)
+	*b = stringBool(value)
+	return err
+}
+
+type idTokenClaims struct {
+	Issuer        string     `json:"iss"`
+	Subject       string     `json:"sub"`
+	Audience      audience   `json:"aud"`
+	ExpiresAt     int64      `json:"exp"`
+	IssuedAt      int64      `json:"iat"`
+	Nonce         string     `json:"nonce"`
+	Email         string     `json:"email"`
+	EmailVerified stringBool `json:"email_verified"`
+	Name          string     `json:"name"`
+}
+
+// Valid is required by jwt-go, the claims are verified by Provider.Verify instead
+func (c *idTokenClaims) Valid() error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// pendingLoginsLimit is the default number of logins which can be in progress at once
+const pendingLoginsLimit = 10000
+
+var ErrTooManyLogins = errors.New("too many logins in progress, try again later")
+
+// PendingLogin holds the secrets of a login between the redirect to the provider and the callback
+type PendingLogin struct {
+	Nonce     string
+	Verifier  string
+	ExpiresAt time.Time
+}
+
+// PendingLogins stores logins in progress keyed by the state parameter, each one can be taken only once.
+// Logins are started by unauthenticated requests, so at most Limit of them are kept and expired ones are swept by Start.
+type PendingLogins struct {
+	Lifetime time.Duration
+	Limit    int
+	Now      func() time.Time
+
+	mutex  sync.Mutex
+	logins map[string]*PendingLogin
+}
+
+func NewPendingLogins(lifetime time.Duration) *PendingLogins {
+	return &PendingLogins{
+		Lifetime: lifetime,
+		Limit:    pendingLoginsLimit,
+		Now:      time.Now,
+		logins:   make(map[string]*PendingLogin),
+	}
+}
+
+// Start sweeps expired logins every lifetime
+func (p *PendingLogins) Start() {
+	ticker := time.NewTicker(p.Lifetime)
+	for range ticker.C {
+		p.Sweep()
+	}
+}
+
+// Put stores the login, ErrTooManyLogins is returned if Limit logins are in progress
+func (p *PendingLogins) Put(state, nonce, verifier string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.logins) >= p.Limit {
+		return ErrTooManyLogins
+	}
+	p.logins[state] = &PendingLogin{
+		Nonce:     nonce,
+		Verifier:  verifier,
+		ExpiresAt: p.Now().Add(p.Lifetime),
+	}
+	return nil
+}
+
+// Take removes and returns the login, nil is returned if it doesn't exist or has expired
+func (p *PendingLogins) Take(state string) *PendingLogin {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	login, ok := p.logins[state]
+	if !ok {
+		return nil
+	}
+	delete(p.logins, state)
+	if p.Now().After(login.ExpiresAt) {
+		return nil
+	}
+	return login
+}
+
+// Sweep removes expired logins
+func (p *PendingLogins) Sweep() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.Now()
+	for key, login := range p.logins {
+		if now.After(login.ExpiresAt) {
+			delete(p.logins, key)
+		}
+	}
+}
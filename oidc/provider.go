@@ -0,0 +1,292 @@
+// Package oidc implements the OpenID Connect authorization code flow with PKCE
+package oidc
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+const (
+	verifierLength = 32
+	clockSkew      = time.Minute
+	keysMinimumAge = 5 * time.Minute
+)
+
+var (
+	ErrDiscovery         = errors.New("could not discover provider configuration")
+	ErrTokenExchange     = errors.New("could not exchange authorization code")
+	ErrIDTokenInvalid    = errors.New("id token invalid")
+	ErrSigningKeyUnknown = errors.New("unknown signing key")
+)
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// IDToken holds the verified claims used to identify the user
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider talks to a single OpenID Connect issuer, the configuration and signing keys are fetched lazily
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+
+	mutex       sync.Mutex
+	config      *discovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+func NewProvider(issuer, clientID, clientSecret, redirectURL string) *Provider {
+	return &Provider{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewVerifier returns a PKCE code verifier
+func NewVerifier() (string, error) {
+	return utils.RandomString(verifierLength)
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *Provider) discover() (*discovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	resp, err := p.Client.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrDiscovery.Error(), err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status code %d", ErrDiscovery.Error(), resp.StatusCode)
+	}
+	config := &discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrDiscovery.Error(), err.Error())
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("%s: issuer mismatch %s", ErrDiscovery.Error(), config.Issuer)
+	}
+	p.config = config
+	return config, nil
+}
+
+// AuthCodeURL returns the address the user has to be redirected to
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	config, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.ClientID)
+	values.Set("redirect_uri", p.RedirectURL)
+	values.Set("scope", strings.Join(p.Scopes, " "))
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", challenge(verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return config.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// Exchange trades the authorization code for an id token and verifies it
+func (p *Provider) Exchange(code, verifier, nonce string) (*IDToken, error) {
+	config, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", p.RedirectURL)
+	values.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, config.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrTokenExchange.Error(), err.Error())
+	}
+	defer resp.Body.Close()
+	tokens := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrTokenExchange.Error(), err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || len(tokens.IDToken) == 0 {
+		return nil, fmt.Errorf("%s: %s %s", ErrTokenExchange.Error(), tokens.Error, tokens.ErrorDescription)
+	}
+	return p.Verify(tokens.IDToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience, expiry and nonce of a raw id token
+func (p *Provider) Verify(raw, nonce string) (*IDToken, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, errors.New("invalid signing method")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrIDTokenInvalid.Error(), err.Error())
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer:
+		return nil, fmt.Errorf("%s: issuer mismatch", ErrIDTokenInvalid.Error())
+	case !claims.Audience.contains(p.ClientID):
+		return nil, fmt.Errorf("%s: audience mismatch", ErrIDTokenInvalid.Error())
+	case claims.ExpiresAt == 0 || now.Add(-clockSkew).Unix() > claims.ExpiresAt:
+		return nil, fmt.Errorf("%s: token expired", ErrIDTokenInvalid.Error())
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%s: nonce mismatch", ErrIDTokenInvalid.Error())
+	case len(claims.Subject) == 0:
+		return nil, fmt.Errorf("%s: no subject", ErrIDTokenInvalid.Error())
+	}
+
+	return &IDToken{
+		Issuer:        p.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+// key returns the signing key, keys are refetched when an unknown key id shows up
+func (p *Provider) key(kid string) (*rsa.PublicKey, error) {
+	p.mutex.Lock()
+	key, ok := lookupKey(p.keys, kid)
+	stale := time.Since(p.keysFetched) > keysMinimumAge
+	p.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale && p.keys != nil {
+		return nil, ErrSigningKeyUnknown
+	}
+
+	config, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Get(config.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (len(jwk.Use) > 0 && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mutex.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	p.mutex.Unlock()
+
+	if key, ok := lookupKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, ErrSigningKeyUnknown
+}
+
+// lookupKey finds the key by its id, providers with a single key don't have to specify the key id
+func lookupKey(keys map[string]*rsa.PublicKey, kid string) (*rsa.PublicKey, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if len(kid) == 0 && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
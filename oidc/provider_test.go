@@ -0,0 +1,318 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testClientID     = "bruschetta"
+	testClientSecret = "secret"
+	testRedirectURL  = "https://example.com/accounts/oidc/callback/"
+)
+
+// mockIdP is a minimal OpenID Connect provider, codes are issued with authorize and redeemed at the token endpoint
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// kid is the id of the only signing key, omitKeyID leaves it out of tokens like some providers do
+	kid       string
+	omitKeyID bool
+	issuer    string
+
+	mutex    sync.Mutex
+	codes    map[string]authorization
+	jwksHits int
+}
+
+type authorization struct {
+	challenge string
+	nonce     string
+	subject   string
+}
+
+func newMockIdP(t *testing.T, kid string) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: kid, codes: map[string]authorization{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/jwks", idp.handleJWKS)
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) handleDiscovery(rw http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(rw).Encode(&discovery{
+		Issuer:                idp.issuer,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *mockIdP) handleJWKS(rw http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	idp.jwksHits++
+	idp.mutex.Unlock()
+	json.NewEncoder(rw).Encode(map[string][]jsonWebKey{
+		"keys": {{
+			Kid: idp.kid,
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *mockIdP) handleToken(rw http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || secret != testClientSecret {
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(&tokenResponse{Error: "invalid_client"})
+		return
+	}
+	r.ParseForm()
+	idp.mutex.Lock()
+	auth, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mutex.Unlock()
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("redirect_uri") != testRedirectURL ||
+		challenge(r.PostForm.Get("code_verifier")) != auth.challenge {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(&tokenResponse{Error: "invalid_grant", ErrorDescription: "code or verifier invalid"})
+		return
+	}
+	json.NewEncoder(rw).Encode(&tokenResponse{IDToken: idp.sign(jwt.MapClaims{
+		"iss":            idp.issuer,
+		"sub":            auth.subject,
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          auth.nonce,
+		"email":          "student@example.com",
+		"email_verified": "true",
+	})})
+}
+
+func (idp *mockIdP) sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if !idp.omitKeyID {
+		token.Header["kid"] = idp.kid
+	}
+	raw, err := token.SignedString(idp.key)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// authorize plays the part of the user logging in at the provider, it returns the code sent to the callback
+func (idp *mockIdP) authorize(t *testing.T, authURL, subject string) (code, state string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	code = "code-" + subject
+	idp.mutex.Lock()
+	idp.codes[code] = authorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), subject: subject}
+	idp.mutex.Unlock()
+	return code, query.Get("state")
+}
+
+func newTestProvider(idp *mockIdP) *Provider {
+	return NewProvider(idp.server.URL+"/", testClientID, testClientSecret, testRedirectURL)
+}
+
+func login(t *testing.T, idp *mockIdP, p *Provider, subject string) (*IDToken, error) {
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthCodeURL("state-"+subject, "nonce-"+subject, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := idp.authorize(t, authURL, subject)
+	if state != "state-"+subject {
+		t.Fatalf("state %q was not passed to the provider", state)
+	}
+	return p.Exchange(code, verifier, "nonce-"+subject)
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	p := newTestProvider(idp)
+	authURL, err := p.AuthCodeURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Errorf("authorization url %s doesn't use the discovered endpoint", authURL)
+	}
+	if query, _ := url.ParseQuery(strings.SplitN(authURL, "?", 2)[1]); query.Get("code_challenge") != challenge("verifier") {
+		t.Errorf("code challenge %s doesn't match the verifier", query.Get("code_challenge"))
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	idp.issuer = "https://impostor.example.com"
+	if _, err := newTestProvider(idp).AuthCodeURL("state", "nonce", "verifier"); err == nil || !strings.HasPrefix(err.Error(), ErrDiscovery.Error()) {
+		t.Fatalf("expected a discovery error, got %v", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	token, err := login(t, idp, newTestProvider(idp), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != "alice" || token.Email != "student@example.com" || !token.EmailVerified || token.Issuer != idp.server.URL {
+		t.Errorf("unexpected id token %+v", token)
+	}
+}
+
+func TestExchangeVerifierMismatch(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	p := newTestProvider(idp)
+	authURL, err := p.AuthCodeURL("state", "nonce", "right-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := idp.authorize(t, authURL, "alice")
+	if _, err := p.Exchange(code, "wrong-verifier", "nonce"); err == nil || !strings.HasPrefix(err.Error(), ErrTokenExchange.Error()) {
+		t.Fatalf("expected a token exchange error, got %v", err)
+	}
+}
+
+func TestExchangeNonceMismatch(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	p := newTestProvider(idp)
+	authURL, err := p.AuthCodeURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := idp.authorize(t, authURL, "alice")
+	if _, err := p.Exchange(code, "verifier", "another-nonce"); err == nil || !strings.Contains(err.Error(), "nonce mismatch") {
+		t.Fatalf("expected a nonce mismatch, got %v", err)
+	}
+}
+
+func TestVerifyRejectsForeignKey(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	p := newTestProvider(idp)
+	foreign := newMockIdP(t, "key-1")
+	foreign.issuer = idp.issuer
+	raw := foreign.sign(jwt.MapClaims{"iss": idp.issuer, "sub": "alice", "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix(), "nonce": "nonce"})
+	if _, err := p.Verify(raw, "nonce"); err == nil {
+		t.Fatal("token signed with a foreign key was accepted")
+	}
+}
+
+func TestJWKSCachedWithoutKeyID(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	idp.omitKeyID = true
+	p := newTestProvider(idp)
+	for _, subject := range []string{"alice", "bob", "carol"} {
+		if _, err := login(t, idp, p, subject); err != nil {
+			t.Fatalf("login of %s failed: %s", subject, err.Error())
+		}
+	}
+	if idp.jwksHits != 1 {
+		t.Errorf("keys were fetched %d times, expected once", idp.jwksHits)
+	}
+}
+
+func TestUnknownKeyIDNotRefetchedEarly(t *testing.T) {
+	idp := newMockIdP(t, "key-1")
+	p := newTestProvider(idp)
+	if _, err := login(t, idp, p, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	idp.kid = "key-2"
+	if _, err := login(t, idp, p, "bob"); err == nil || !strings.Contains(err.Error(), ErrSigningKeyUnknown.Error()) {
+		t.Fatalf("expected an unknown signing key, got %v", err)
+	}
+	if idp.jwksHits != 1 {
+		t.Errorf("keys were fetched %d times, expected once", idp.jwksHits)
+	}
+}
+
+func TestPendingLogins(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	logins := NewPendingLogins(10 * time.Minute)
+	logins.Now = func() time.Time { return now }
+
+	logins.Put("state", "nonce", "verifier")
+	if login := logins.Take("other-state"); login != nil {
+		t.Fatalf("login taken with a mismatched state: %+v", login)
+	}
+	login := logins.Take("state")
+	if login == nil || login.Nonce != "nonce" || login.Verifier != "verifier" {
+		t.Fatalf("unexpected login %+v", login)
+	}
+	if login := logins.Take("state"); login != nil {
+		t.Fatal("login was taken twice")
+	}
+
+	logins.Put("expiring", "nonce", "verifier")
+	now = now.Add(11 * time.Minute)
+	if login := logins.Take("expiring"); login != nil {
+		t.Fatal("expired login was taken")
+	}
+}
+
+func TestPendingLoginsLimit(t *testing.T) {
+	now := time.Date(2017, time.June, 12, 8, 0, 0, 0, time.UTC)
+	logins := NewPendingLogins(10 * time.Minute)
+	logins.Now = func() time.Time { return now }
+	logins.Limit = 2
+
+	if err := logins.Put("first", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logins.Put("second", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logins.Put("third", "nonce", "verifier"); err != ErrTooManyLogins {
+		t.Fatalf("expected too many logins, got %v", err)
+	}
+
+	// taken logins make room right away, expired ones once swept
+	logins.Take("first")
+	if err := logins.Put("third", "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(11 * time.Minute)
+	if err := logins.Put("fourth", "nonce", "verifier"); err != ErrTooManyLogins {
+		t.Fatalf("expected too many logins before sweeping, got %v", err)
+	}
+	logins.Sweep()
+	if err := logins.Put("fourth", "nonce", "verifier"); err != nil {
+		t.Fatalf("login rejected after sweeping: %s", err.Error())
+	}
+}
@@ -23,86 +23,300 @@ import (
 )
 
 const minimumTimetableLongevity = 2 * time.Hour
+
+// DefaultPeriod is the period of timetables served when none is specified
+const DefaultPeriod = uint(3)
 const pathPrefix = "/var/lib/uek/"
 
 var (
-	ErrTimetableUnknown   = errors.New("unknown error occured")
-	ErrTimetableNoGroupId = errors.New("no group id specified for this user")
+	ErrTimetableUnknown      = errors.New("unknown error occured")
+	ErrTimetableNoGroupId    = errors.New("no group id specified for this user")
+	ErrTimetableNoClass      = errors.New("no upcoming classes")
+	ErrTimetableNotFound     = errors.New("no such teacher or room")
+	ErrTimetableSinceInvalid = errors.New("invalid since, it has to be an RFC 3339 time or a YYYY-MM-DD date")
 )
 
 type Coordinator struct {
-	EventPipe    models.EventPipe
-	Logger       *log.Logger
-	Database     *gorm.DB
-	ticker       *time.Ticker
-	stop         chan interface{}
-	cache        map[string]*Timetable
-	mapMutex     *sync.RWMutex
-	associations []byte
+	EventPipe   models.EventPipe
+	Logger      *log.Logger
+	Database    *gorm.DB
+	ticker      *time.Ticker
+	stop        chan interface{}
+	cache       map[string]*Timetable
+	mapMutex    *sync.RWMutex
+	directories map[ResourceType]*directory
+	occupancy   *occupancy
+	// occupancyTicker drives room occupancy refreshes, they take long enough to delay update checks otherwise
+	occupancyTicker *time.Ticker
+	// reminderTicker drives class reminders, remindedUntil is the time they were last sent up to
+	reminderTicker *time.Ticker
+	remindedUntil  time.Time
 }
 
 func NewCoordinator(interval time.Duration, database *gorm.DB, logger *log.Logger, pipe models.EventPipe) *Coordinator {
 	return &Coordinator{
-		Logger:    logger,
-		EventPipe: pipe,
-		Database:  database,
-		ticker:    time.NewTicker(interval),
-		stop:      make(chan interface{}),
-		mapMutex:  &sync.RWMutex{},
-		cache:     make(map[string]*Timetable),
+		Logger:          logger,
+		EventPipe:       pipe,
+		Database:        database,
+		ticker:          time.NewTicker(interval),
+		stop:            make(chan interface{}),
+		mapMutex:        &sync.RWMutex{},
+		cache:           make(map[string]*Timetable),
+		directories:     make(map[ResourceType]*directory),
+		occupancyTicker: time.NewTicker(occupancyInterval),
+		reminderTicker:  time.NewTicker(reminderInterval),
 	}
 }
 
 func (c *Coordinator) Register(router *mux.Router) error {
 	router.HandleFunc("/groups/", c.HandleGetAssociations).Methods(http.MethodGet)
+	router.HandleFunc("/teachers/", c.HandleGetTeachers).Methods(http.MethodGet)
+	router.HandleFunc("/rooms/", c.HandleGetRooms).Methods(http.MethodGet)
+	router.HandleFunc("/rooms/free/", c.HandleGetFreeRooms).Methods(http.MethodGet)
+	for _, prefix := range []string{"/teachers/{teacher:[0-9]+}/", "/rooms/{room:[0-9]+}/"} {
+		router.HandleFunc(prefix, c.HandleGetTimetable).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"today/", c.HandleGetToday).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"week/", c.HandleGetWeek).Methods(http.MethodGet)
+		router.HandleFunc(prefix+"next/", c.HandleGetNext).Methods(http.MethodGet)
+	}
 	router.HandleFunc("/{group:[0-9]+}/{period:[0-9]+}/", c.HandleGetTimetable).Methods(http.MethodGet)
+	router.HandleFunc("/{group:[0-9]+}/today/", c.HandleGetToday).Methods(http.MethodGet)
+	router.HandleFunc("/{group:[0-9]+}/week/", c.HandleGetWeek).Methods(http.MethodGet)
+	router.HandleFunc("/{group:[0-9]+}/next/", c.HandleGetNext).Methods(http.MethodGet)
+	router.HandleFunc("/{group:[0-9]+}/changes/", c.HandleGetChanges).Methods(http.MethodGet)
 	router.Handle("/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleGetTimetable))).Methods(http.MethodGet)
+	router.Handle("/today/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleGetToday))).Methods(http.MethodGet)
+	router.Handle("/week/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleGetWeek))).Methods(http.MethodGet)
+	router.Handle("/next/", middleware.RequiresAuth(models.RoleUser, http.HandlerFunc(c.HandleGetNext))).Methods(http.MethodGet)
 	return nil
 }
 
 func (c *Coordinator) HandleGetAssociations(rw http.ResponseWriter, r *http.Request) {
+	c.mapMutex.RLock()
+	defer c.mapMutex.RUnlock()
 	rw.WriteHeader(http.StatusOK)
-	rw.Write(c.associations)
+	if dir, ok := c.directories[ResourceGroup]; ok {
+		rw.Write(dir.raw)
+	}
+}
+
+// HandleGetTeachers lists teachers sorted by name, ?q= searches names and departments
+func (c *Coordinator) HandleGetTeachers(rw http.ResponseWriter, r *http.Request) {
+	c.writeDirectory(rw, r, ResourceTeacher)
+}
+
+// HandleGetRooms lists rooms sorted by name, ?q= searches names and buildings
+func (c *Coordinator) HandleGetRooms(rw http.ResponseWriter, r *http.Request) {
+	c.writeDirectory(rw, r, ResourceRoom)
+}
+
+// HandleGetFreeRooms lists rooms vacant in the range, for at least the given duration if specified
+func (c *Coordinator) HandleGetFreeRooms(rw http.ResponseWriter, r *http.Request) {
+	query, err := ParseFreeRoomQuery(r.URL.Query())
+	if err != nil {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return
+	}
+	c.mapMutex.RLock()
+	occ := c.occupancy
+	c.mapMutex.RUnlock()
+	if occ == nil {
+		utils.NewErrorResponse(ErrOccupancyNotReady).Write(http.StatusServiceUnavailable, rw)
+		return
+	}
+	c.write(rw, occ.Free(query))
 }
 
+func (c *Coordinator) writeDirectory(rw http.ResponseWriter, r *http.Request, kind ResourceType) {
+	c.mapMutex.RLock()
+	entries := []DirectoryEntry{}
+	if dir, ok := c.directories[kind]; ok {
+		entries = dir.Search(r.URL.Query().Get("q"))
+	}
+	c.mapMutex.RUnlock()
+	c.write(rw, entries)
+}
+
+// GroupExists reports whether the group id is present in the scraped group associations
+func (c *Coordinator) GroupExists(id uint) bool {
+	return c.ResourceExists(ResourceGroup, id)
+}
+
+// ResourceExists reports whether the id is present in the scraped directory of the resource type
+func (c *Coordinator) ResourceExists(kind ResourceType, id uint) bool {
+	c.mapMutex.RLock()
+	defer c.mapMutex.RUnlock()
+	dir, ok := c.directories[kind]
+	return ok && dir.ids[id]
+}
+
+func (c *Coordinator) setDirectory(kind ResourceType, byt []byte) error {
+	dir, err := newDirectory(byt)
+	if err != nil {
+		return err
+	}
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	c.directories[kind] = dir
+	return nil
+}
+
+// HandleGetTimetable serves the whole timetable, narrowed down by the filter in query parameters
 func (c *Coordinator) HandleGetTimetable(rw http.ResponseWriter, r *http.Request) {
+	c.serveFiltered(rw, r, func(filter *Filter) {})
+}
+
+// HandleGetToday serves today's classes
+func (c *Coordinator) HandleGetToday(rw http.ResponseWriter, r *http.Request) {
+	c.serveFiltered(rw, r, func(filter *Filter) {
+		filter.From = Today()
+		filter.To = filter.From.AddDate(0, 0, 1)
+	})
+}
+
+// HandleGetWeek serves classes of the current week, from Monday to Sunday
+func (c *Coordinator) HandleGetWeek(rw http.ResponseWriter, r *http.Request) {
+	c.serveFiltered(rw, r, func(filter *Filter) {
+		filter.From = WeekStart()
+		filter.To = filter.From.AddDate(0, 0, 7)
+	})
+}
+
+// HandleGetNext serves the first class which hasn't started yet, filters apply as well
+func (c *Coordinator) HandleGetNext(rw http.ResponseWriter, r *http.Request) {
+	tt, filter := c.requestedTimetable(rw, r)
+	if tt == nil {
+		return
+	}
+	next := tt.Next(LocalNow(), filter)
+	if next == nil {
+		utils.NewErrorResponse(ErrTimetableNoClass).Write(http.StatusNotFound, rw)
+		return
+	}
+	c.write(rw, next)
+}
+
+func (c *Coordinator) serveFiltered(rw http.ResponseWriter, r *http.Request, narrow func(filter *Filter)) {
+	tt, filter := c.requestedTimetable(rw, r)
+	if tt == nil {
+		return
+	}
+	narrow(filter)
+	c.write(rw, tt.Filter(filter))
+}
+
+// requestedTimetable loads the timetable of the group, teacher or room in the path, or the merged timetable of the user's groups,
+// along with the filter from query parameters. It writes an error response and returns nil if it's not possible.
+func (c *Coordinator) requestedTimetable(rw http.ResponseWriter, r *http.Request) (*Timetable, *Filter) {
 	vars := mux.Vars(r)
 
-	var group *uint
-	period := uint(3)
+	groups := []uint{}
+	period := DefaultPeriod
+	if per, err := strconv.Atoi(vars["period"]); err == nil {
+		period = uint(per)
+	} else if per, err := strconv.Atoi(r.URL.Query().Get("period")); err == nil && per > 0 {
+		period = uint(per)
+	}
+
+	if kind, id, ok := requestedResource(vars); ok {
+		if !c.ResourceExists(kind, id) {
+			utils.NewErrorResponse(ErrTimetableNotFound).Write(http.StatusNotFound, rw)
+			return nil, nil
+		}
+		filter, err := ParseFilter(r.URL.Query())
+		if err != nil {
+			utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+			return nil, nil
+		}
+		tt, _, err := c.LoadResource(kind, id, period, false)
+		if err != nil {
+			(&utils.ErrorResponse{
+				Errors:      []string{ErrTimetableUnknown.Error()},
+				DebugErrors: []string{err.Error()},
+			}).Write(http.StatusInternalServerError, rw)
+			return nil, nil
+		}
+		return tt, filter
+	}
 
 	if id, err := strconv.Atoi(vars["group"]); err != nil {
 		if user, ok := r.Context().Value(middleware.ContextUserKey).(*models.User); ok {
-			group = user.Group
+			if err := user.LoadGroups(c.Database); err != nil {
+				(&utils.ErrorResponse{
+					Errors:      []string{ErrTimetableUnknown.Error()},
+					DebugErrors: []string{err.Error()},
+				}).Write(http.StatusInternalServerError, rw)
+				return nil, nil
+			}
+			groups = user.AllGroups()
 		}
 	} else {
-		per, _ := strconv.Atoi(vars["period"])
-		period = uint(per)
-		temp := uint(id)
-		group = &temp
+		groups = append(groups, uint(id))
 	}
 
-	if group == nil {
+	if len(groups) == 0 {
 		utils.NewErrorResponse(ErrTimetableNoGroupId).Write(http.StatusBadRequest, rw)
-		return
+		return nil, nil
 	}
 
-	tt, _, err := c.Load(*group, period, false)
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		utils.NewErrorResponse(err).Write(http.StatusBadRequest, rw)
+		return nil, nil
+	}
+
+	tt, err := c.LoadMerged(groups, period)
 	if err != nil {
 		(&utils.ErrorResponse{
 			Errors:      []string{ErrTimetableUnknown.Error()},
 			DebugErrors: []string{err.Error()},
 		}).Write(http.StatusInternalServerError, rw)
-		return
+		return nil, nil
+	}
+	return tt, filter
+}
+
+// requestedResource reads the teacher or room id from the path
+func requestedResource(vars map[string]string) (ResourceType, uint, bool) {
+	if id, err := strconv.Atoi(vars["teacher"]); err == nil {
+		return ResourceTeacher, uint(id), true
 	}
-	enc := json.NewEncoder(rw)
-	if err := enc.Encode(tt); err != nil {
+	if id, err := strconv.Atoi(vars["room"]); err == nil {
+		return ResourceRoom, uint(id), true
+	}
+	return "", 0, false
+}
+
+func (c *Coordinator) write(rw http.ResponseWriter, v interface{}) {
+	byt, err := json.Marshal(v)
+	if err != nil {
 		(&utils.ErrorResponse{
 			Errors:      []string{ErrTimetableUnknown.Error()},
 			DebugErrors: []string{err.Error()},
 		}).Write(http.StatusInternalServerError, rw)
 		return
 	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(byt)
+}
+
+// LoadMerged loads timetables of the groups and merges them if there's more than one
+func (c *Coordinator) LoadMerged(groups []uint, period uint) (*Timetable, error) {
+	if len(groups) == 0 {
+		return nil, ErrTimetableNoGroupId
+	}
+	timetables := []*Timetable{}
+	for _, group := range groups {
+		tt, _, err := c.Load(group, period, false)
+		if err != nil {
+			return nil, err
+		}
+		timetables = append(timetables, tt)
+	}
+	if len(timetables) == 1 {
+		return timetables[0], nil
+	}
+	return Merge(timetables...), nil
 }
 
 func (c *Coordinator) Start() error {
@@ -110,33 +324,13 @@ func (c *Coordinator) Start() error {
 	if err != nil {
 		return err
 	}
-	//Fetch group associations if not present
-	if f, err := os.Open(pathPrefix + "groups/group-assoc.json"); err != nil && os.IsNotExist(err) {
-		c.Logger.Println("fetching group ids for reference")
-		f, err := os.Create(pathPrefix + "groups/group-assoc.json")
-		if err != nil {
-			return fmt.Errorf("could not create group associations file: %s", err.Error())
-		}
-		defer f.Close()
-		groups, err := ScrapeGroupIDs()
-		if err != nil {
-			return fmt.Errorf("could not scrape group assocaitions: %s", err.Error())
-		}
-		byt, err := json.Marshal(&groups)
-		if err != nil {
-			return fmt.Errorf("could not encode group associations: %s", err.Error())
-		}
-		if _, err := f.Write(byt); err != nil {
-			return fmt.Errorf("could not write associations to file: %s", err.Error())
-		}
-		c.associations = byt
-	} else if err == nil {
-		defer f.Close()
-		byt, err := ioutil.ReadFile(pathPrefix + "groups/group-assoc.json")
-		if err != nil {
-			return fmt.Errorf("could not read group associations: %s", err.Error())
+	// groups are essential, teachers and rooms only serve their own endpoints
+	for _, kind := range ResourceTypes {
+		if err := c.loadDirectory(kind); err != nil && kind == ResourceGroup {
+			return err
+		} else if err != nil {
+			c.Logger.Printf("could not load %s directory: %s\n", kind, err.Error())
 		}
-		c.associations = byt
 	}
 
 	c.Logger.Println("Starting update check routine")
@@ -145,6 +339,8 @@ func (c *Coordinator) Start() error {
 	if err != nil {
 		return err
 	}
+	go c.runOccupancy()
+	go c.runReminders()
 	//return nil
 	if err := c.checkUpdates(); err != nil {
 		c.Logger.Printf("could not check updates: %s\n", err.Error())
@@ -163,20 +359,56 @@ func (c *Coordinator) Start() error {
 	}
 }
 
+// directoryFiles are names of files with scraped ids of each resource type
+var directoryFiles = map[ResourceType]string{
+	ResourceGroup:   "group-assoc.json",
+	ResourceTeacher: "teacher-assoc.json",
+	ResourceRoom:    "room-assoc.json",
+}
+
+// loadDirectory reads scraped ids of the resource type, they are scraped if not present
+func (c *Coordinator) loadDirectory(kind ResourceType) error {
+	path := pathPrefix + "groups/" + directoryFiles[kind]
+	if f, err := os.Open(path); err != nil && os.IsNotExist(err) {
+		c.Logger.Printf("fetching %s ids for reference\n", kind)
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("could not create associations file: %s", err.Error())
+		}
+		defer f.Close()
+		ids, err := ScrapeIDs(kind)
+		if err != nil {
+			os.Remove(path)
+			return fmt.Errorf("could not scrape associations: %s", err.Error())
+		}
+		byt, err := json.Marshal(&ids)
+		if err != nil {
+			return fmt.Errorf("could not encode associations: %s", err.Error())
+		}
+		if _, err := f.Write(byt); err != nil {
+			return fmt.Errorf("could not write associations to file: %s", err.Error())
+		}
+		if err := c.setDirectory(kind, byt); err != nil {
+			return fmt.Errorf("could not decode associations: %s", err.Error())
+		}
+	} else if err == nil {
+		defer f.Close()
+		byt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read associations: %s", err.Error())
+		}
+		if err := c.setDirectory(kind, byt); err != nil {
+			return fmt.Errorf("could not decode associations: %s", err.Error())
+		}
+	}
+	return nil
+}
+
 func (c *Coordinator) checkUpdates() error {
-	res := []uint{}
-	rows, err := c.Database.Raw("SELECT DISTINCT \"group\" FROM \"users\"").Rows()
+	res, err := models.ActiveGroups(c.Database)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var i uint
-		if err = rows.Scan(&i); err != nil {
-			return err
-		}
-		res = append(res, i)
-	}
 
 	for _, group := range res {
 		c.Logger.Printf("checking plan updates for %d-%d\n", group, 3)
@@ -185,6 +417,9 @@ func (c *Coordinator) checkUpdates() error {
 			c.Logger.Printf("could not fetch and parse timetable for group: %d, period: %d, err: %s\n", group, 3, err.Error())
 			continue
 		}
+		if err := c.recordBaseline(old, 3); err != nil {
+			c.Logger.Printf("could not record timetable of group %d: %s\n", group, err.Error())
+		}
 		if !cached {
 			continue
 		}
@@ -194,17 +429,12 @@ func (c *Coordinator) checkUpdates() error {
 			continue
 		}
 		diff := old.Diff(*new)
-		pri := models.EventPriorityHigh
 		if len(diff) > 0 {
 			c.Logger.Printf("changes detected in %d-%d\n", group, 3)
-			event := &models.Event{
-				Group:               &group,
-				Name:                "Zmiana w planie zajęć!",
-				NotificationMessage: "Zapoznaj się z nowym planem zajęć.",
-				Description:         diff.String(),
-				Priority:            &pri,
+			if err := c.recordVersion(new, 3, diff); err != nil {
+				c.Logger.Printf("could not record timetable changes of group %d: %s\n", group, err.Error())
 			}
-			if err := event.Add(c.Database, c.EventPipe); err != nil {
+			if err := c.notifyChanges(group, diff); err != nil {
 				c.Logger.Printf("could not send timetable diff: %s", err.Error())
 			}
 		}
@@ -213,14 +443,71 @@ func (c *Coordinator) checkUpdates() error {
 	return nil
 }
 
+// runOccupancy builds the room occupancy index right away and refreshes it on every tick of the occupancy ticker
+func (c *Coordinator) runOccupancy() {
+	for ok := true; ok; _, ok = <-c.occupancyTicker.C {
+		if err := c.refreshOccupancy(); err != nil {
+			c.Logger.Printf("could not refresh room occupancy: %s\n", err.Error())
+		}
+	}
+}
+
+// refreshOccupancy builds the room occupancy index from stored room timetables,
+// once it's older than occupancyLongevity the timetables are fetched again and the index is rebuilt
+func (c *Coordinator) refreshOccupancy() error {
+	c.mapMutex.RLock()
+	dir, ok := c.directories[ResourceRoom]
+	previous := c.occupancy
+	c.mapMutex.RUnlock()
+	if !ok {
+		return errors.New("room directory is not loaded")
+	}
+	if previous != nil && time.Since(previous.builtAt) < occupancyLongevity {
+		return nil
+	}
+	force := previous != nil
+
+	timetables := map[uint]*Timetable{}
+	for _, room := range dir.entries {
+		tt, cached, err := c.LoadResource(ResourceRoom, room.ID, DefaultPeriod, force)
+		if err != nil && force {
+			// keep using the stored timetable if planzajec is unavailable
+			tt, cached, err = c.LoadResource(ResourceRoom, room.ID, DefaultPeriod, false)
+		}
+		if err != nil {
+			c.Logger.Printf("could not fetch timetable of room %d: %s\n", room.ID, err.Error())
+			continue
+		}
+		timetables[room.ID] = tt
+		if !cached {
+			time.Sleep(delay)
+		}
+	}
+
+	occ := newOccupancy(dir.entries, timetables)
+	c.mapMutex.Lock()
+	c.occupancy = occ
+	c.mapMutex.Unlock()
+	return nil
+}
+
 func (c *Coordinator) Stop() {
 	c.ticker.Stop()
+	c.occupancyTicker.Stop()
+	c.reminderTicker.Stop()
 }
 
 func (c *Coordinator) Load(group uint, period uint, force bool) (*Timetable, bool, error) {
+	return c.LoadResource(ResourceGroup, group, period, force)
+}
+
+// LoadResource returns the cached timetable of the resource, it's fetched if it's not cached or force is set.
+// The second value reports whether the timetable came from the cache.
+func (c *Coordinator) LoadResource(kind ResourceType, id uint, period uint, force bool) (*Timetable, bool, error) {
+	key := cacheKey(kind, id, period)
 	// check if timetable is in cache already
 	c.mapMutex.RLock()
-	if tt, ok := c.cache[fmt.Sprintf("%d-%d", group, period)]; !force && ok {
+	if tt, ok := c.cache[key]; !force && ok {
 		c.mapMutex.RUnlock()
 		return tt, true, nil
 	}
@@ -230,7 +517,7 @@ func (c *Coordinator) Load(group uint, period uint, force bool) (*Timetable, boo
 
 	// if forcing update fetch the new timetable
 	if force {
-		parsed, err := TimetableFromId(group, period)
+		parsed, err := FetchTimetable(kind, id, period)
 		if err != nil {
 			return nil, false, err
 		}
@@ -242,9 +529,9 @@ func (c *Coordinator) Load(group uint, period uint, force bool) (*Timetable, boo
 
 	if tt == nil {
 		// open the file we might have saved to, TODO: fix this
-		file, err := os.Open(fmt.Sprintf("%s%s%d-%d.json", pathPrefix, "timetables/", group, period))
+		file, err := os.Open(fmt.Sprintf("%s%s%s.json", pathPrefix, "timetables/", key))
 		if err != nil {
-			return c.Load(group, period, true)
+			return c.LoadResource(kind, id, period, true)
 		}
 		defer file.Close()
 		base := &Timetable{}
@@ -257,15 +544,19 @@ func (c *Coordinator) Load(group uint, period uint, force bool) (*Timetable, boo
 
 	// decode
 	c.mapMutex.Lock()
-	c.cache[fmt.Sprintf("%d-%d", group, period)] = tt
+	c.cache[key] = tt
 	c.mapMutex.Unlock()
 	return tt, !force, nil
 }
 
 func (c *Coordinator) Save(tt *Timetable, period uint) error {
+	kind := tt.Type
+	if len(kind) == 0 {
+		kind = ResourceGroup
+	}
 	c.mapMutex.Lock()
 	defer c.mapMutex.Unlock()
-	file, err := os.OpenFile(fmt.Sprintf("%s%s%d-%d.json", pathPrefix, "timetables/", tt.GroupID, period), os.O_CREATE|os.O_RDWR, 0755)
+	file, err := os.OpenFile(fmt.Sprintf("%s%s%s.json", pathPrefix, "timetables/", cacheKey(kind, tt.GroupID, period)), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
 	if err != nil {
 		return err
 	}
@@ -280,3 +571,11 @@ func (c *Coordinator) Save(tt *Timetable, period uint) error {
 	}
 	return file.Close()
 }
+
+// cacheKey identifies the timetable in the cache and on disk, group keys have no prefix for compatibility with stored files
+func cacheKey(kind ResourceType, id uint, period uint) string {
+	if kind == ResourceGroup {
+		return fmt.Sprintf("%d-%d", id, period)
+	}
+	return fmt.Sprintf("%s-%d-%d", kind, id, period)
+}
@@ -0,0 +1,225 @@
+package timetable
+
+import (
+	"sort"
+	"time"
+)
+
+// ChangeKind classifies a change of a class
+type ChangeKind string
+
+const (
+	ChangeAdded     ChangeKind = "added"
+	ChangeCancelled ChangeKind = "cancelled"
+	// ChangeMoved means the class takes place at another time, possibly in another room as well
+	ChangeMoved          ChangeKind = "moved"
+	ChangeRoomChanged    ChangeKind = "room_changed"
+	ChangeTeacherChanged ChangeKind = "teacher_changed"
+	// ChangeOther covers changes of notes, type or the end of the class
+	ChangeOther ChangeKind = "changed"
+)
+
+// maximumMoveDistance limits how far a class can be moved, more distant classes are reported as cancelled and added
+const maximumMoveDistance = 14 * 24 * time.Hour
+
+type TimetableDiff []ClassDiff
+
+func (td TimetableDiff) String() string {
+	message := ""
+	for _, d := range td {
+		message += d.String()
+		message += "\n\n"
+	}
+	return message
+}
+
+type ClassDiff struct {
+	Kind ChangeKind `json:"kind"`
+	Old  *Class     `json:"old"`
+	New  *Class     `json:"new"`
+}
+
+var changeLabels = map[ChangeKind]string{
+	ChangeAdded:          "Nowe",
+	ChangeCancelled:      "Wycofane",
+	ChangeMoved:          "Przeniesione",
+	ChangeRoomChanged:    "Zmiana sali",
+	ChangeTeacherChanged: "Zmiana prowadzącego",
+	ChangeOther:          "Zmiana",
+}
+
+var shortWeekdays = []string{"Nd", "Pn", "Wt", "Śr", "Cz", "Pt", "So"}
+
+func (cd ClassDiff) String() string {
+	switch cd.Kind {
+	case ChangeCancelled:
+		return cd.Label() + ": " + cd.Old.String()
+	case ChangeAdded:
+		return cd.Label() + ": " + cd.New.String()
+	}
+	return cd.Label() + ":\n\t" + cd.Old.String() + "\n\tna: " + cd.New.String()
+}
+
+// Label names the kind of the change in Polish
+func (cd ClassDiff) Label() string {
+	if label, ok := changeLabels[cd.Kind]; ok {
+		return label
+	}
+	return changeLabels[ChangeOther]
+}
+
+// Subject is the name of the changed class
+func (cd ClassDiff) Subject() string {
+	if cd.New != nil {
+		return cd.New.Class
+	}
+	return cd.Old.Class
+}
+
+// Summary briefly describes what changed, e.g. the old and the new room, for space-constrained renderers
+func (cd ClassDiff) Summary() string {
+	switch cd.Kind {
+	case ChangeAdded:
+		return shortTerm(cd.New) + ", " + cd.New.Room
+	case ChangeCancelled:
+		return shortTerm(cd.Old) + ", " + cd.Old.Room
+	case ChangeMoved:
+		return shortTerm(cd.Old) + " → " + shortTerm(cd.New) + ", " + cd.New.Room
+	case ChangeRoomChanged:
+		return shortTerm(cd.New) + ", " + cd.Old.Room + " → " + cd.New.Room
+	case ChangeTeacherChanged:
+		return shortTerm(cd.New) + ", " + cd.Old.Teacher + " → " + cd.New.Teacher
+	}
+	return shortTerm(cd.New) + ", " + cd.New.Room
+}
+
+// shortTerm formats the start of the class like "Wt 13.06 09:30"
+func shortTerm(class *Class) string {
+	return shortWeekdays[class.Start.Weekday()] + " " + class.Start.Format("02.01 15:04")
+}
+
+// classify names the most important difference between the paired classes
+func classify(old, new *Class) ChangeKind {
+	switch {
+	case !old.Start.Equal(new.Start):
+		return ChangeMoved
+	case old.Room != new.Room:
+		return ChangeRoomChanged
+	case old.Teacher != new.Teacher:
+		return ChangeTeacherChanged
+	}
+	return ChangeOther
+}
+
+// Diff pairs classes of both timetables and reports the differences, neither timetable is modified.
+// Classes are paired in passes, each stricter pass first so that parallel and duplicate classes pair with their counterparts:
+// identical classes, then the same subject, type and teacher at the same time, then the same subject, type and teacher
+// at the nearest other time (moved), then the same subject and type at the same time (teacher changed).
+// Classes left unpaired are reported as cancelled or added.
+func (old Timetable) Diff(new Timetable) TimetableDiff {
+	d := &differ{
+		old:       old.Classes,
+		new:       new.Classes,
+		oldPaired: make([]bool, len(old.Classes)),
+		newPaired: make([]bool, len(new.Classes)),
+		diff:      []ClassDiff{},
+	}
+
+	d.pairAtSameTime(func(o, n *Class) bool { return o.Equal(n) }, false)
+	d.pairAtSameTime(func(o, n *Class) bool { return sameSubject(o, n) && o.Teacher == n.Teacher }, true)
+	d.pairMoved()
+	d.pairAtSameTime(sameSubject, true)
+
+	for i, class := range d.old {
+		if !d.oldPaired[i] {
+			d.diff = append(d.diff, ClassDiff{Kind: ChangeCancelled, Old: class})
+		}
+	}
+	for i, class := range d.new {
+		if !d.newPaired[i] {
+			d.diff = append(d.diff, ClassDiff{Kind: ChangeAdded, New: class})
+		}
+	}
+
+	sort.SliceStable(d.diff, func(i, j int) bool {
+		return d.diff[i].start().Before(d.diff[j].start())
+	})
+	return d.diff
+}
+
+// start is the time the change concerns, the new one if the class still takes place
+func (cd ClassDiff) start() time.Time {
+	if cd.New != nil {
+		return cd.New.Start
+	}
+	return cd.Old.Start
+}
+
+type differ struct {
+	old, new             []*Class
+	oldPaired, newPaired []bool
+	diff                 TimetableDiff
+}
+
+func (d *differ) pair(i, j int, report bool) {
+	d.oldPaired[i] = true
+	d.newPaired[j] = true
+	if report {
+		d.diff = append(d.diff, ClassDiff{Kind: classify(d.old[i], d.new[j]), Old: d.old[i], New: d.new[j]})
+	}
+}
+
+// pairAtSameTime pairs unpaired classes starting at the same time which match, in order of appearance
+func (d *differ) pairAtSameTime(match func(o, n *Class) bool, report bool) {
+	for j, newClass := range d.new {
+		if d.newPaired[j] {
+			continue
+		}
+		for i, oldClass := range d.old {
+			if d.oldPaired[i] || !oldClass.Start.Equal(newClass.Start) || !match(oldClass, newClass) {
+				continue
+			}
+			d.pair(i, j, report && !oldClass.Equal(newClass))
+			break
+		}
+	}
+}
+
+// pairMoved pairs unpaired classes of the same subject, type and teacher at different times, nearest ones first
+func (d *differ) pairMoved() {
+	type candidate struct {
+		i, j     int
+		distance time.Duration
+	}
+	candidates := []candidate{}
+	for j, newClass := range d.new {
+		if d.newPaired[j] {
+			continue
+		}
+		for i, oldClass := range d.old {
+			if d.oldPaired[i] || !sameSubject(oldClass, newClass) || oldClass.Teacher != newClass.Teacher {
+				continue
+			}
+			distance := newClass.Start.Sub(oldClass.Start)
+			if distance < 0 {
+				distance = -distance
+			}
+			if distance <= maximumMoveDistance {
+				candidates = append(candidates, candidate{i: i, j: j, distance: distance})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].distance < candidates[b].distance
+	})
+	for _, c := range candidates {
+		if d.oldPaired[c.i] || d.newPaired[c.j] {
+			continue
+		}
+		d.pair(c.i, c.j, true)
+	}
+}
+
+func sameSubject(o, n *Class) bool {
+	return o.Class == n.Class && o.Type == n.Type
+}
@@ -0,0 +1,144 @@
+package timetable
+
+import (
+	"testing"
+	"time"
+)
+
+func testClass(subject, classType, teacher, room string, start time.Time) *Class {
+	return &Class{Start: start, End: start.Add(90 * time.Minute), Class: subject, Type: classType, Teacher: teacher, Room: room}
+}
+
+func june(day, hour, minute int) time.Time {
+	return time.Date(2017, time.June, day, hour, minute, 0, 0, time.UTC)
+}
+
+// expectedChange refers to classes of the test case by index, -1 stands for nil
+type expectedChange struct {
+	kind     ChangeKind
+	old, new int
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new []*Class
+		expected []expectedChange
+	}{
+		{
+			name: "unchanged",
+			old: []*Class{
+				testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0)),
+				testClass("Bazy danych", "ćwiczenia", "mgr Kowalski", "Paw.C 305", june(12, 9, 45)),
+			},
+			new: []*Class{
+				testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0)),
+				testClass("Bazy danych", "ćwiczenia", "mgr Kowalski", "Paw.C 305", june(12, 9, 45)),
+			},
+			expected: []expectedChange{},
+		},
+		{
+			name:     "moved to another hour",
+			old:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0))},
+			new:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 11, 30))},
+			expected: []expectedChange{{ChangeMoved, 0, 0}},
+		},
+		{
+			name:     "room changed",
+			old:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0))},
+			new:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula B", june(12, 8, 0))},
+			expected: []expectedChange{{ChangeRoomChanged, 0, 0}},
+		},
+		{
+			name:     "teacher changed",
+			old:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0))},
+			new:      []*Class{testClass("Programowanie", "wykład", "dr Wiśniewska", "Aula A", june(12, 8, 0))},
+			expected: []expectedChange{{ChangeTeacherChanged, 0, 0}},
+		},
+		{
+			name: "cancelled and added",
+			old: []*Class{
+				testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0)),
+				testClass("Bazy danych", "ćwiczenia", "mgr Kowalski", "Paw.C 305", june(12, 9, 45)),
+			},
+			new: []*Class{
+				testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(12, 8, 0)),
+				testClass("Statystyka", "ćwiczenia", "dr Zając", "Paw.D 12", june(13, 11, 30)),
+			},
+			expected: []expectedChange{{ChangeCancelled, 1, -1}, {ChangeAdded, -1, 1}},
+		},
+		{
+			name: "parallel classes at the same start",
+			old: []*Class{
+				testClass("Język angielski", "lektorat", "mgr Smith", "Paw.A 101", june(12, 8, 0)),
+				testClass("Język angielski", "lektorat", "mgr Brown", "Paw.A 102", june(12, 8, 0)),
+			},
+			new: []*Class{
+				testClass("Język angielski", "lektorat", "mgr Brown", "Paw.A 102", june(12, 8, 0)),
+				testClass("Język angielski", "lektorat", "mgr Smith", "Paw.A 201", june(12, 8, 0)),
+			},
+			expected: []expectedChange{{ChangeRoomChanged, 0, 1}},
+		},
+		{
+			name: "duplicate classes",
+			old: []*Class{
+				testClass("Programowanie", "laboratorium", "dr Nowak", "Paw.C 305", june(12, 8, 0)),
+				testClass("Programowanie", "laboratorium", "dr Nowak", "Paw.C 305", june(12, 8, 0)),
+			},
+			new: []*Class{
+				testClass("Programowanie", "laboratorium", "dr Nowak", "Paw.C 305", june(12, 8, 0)),
+			},
+			expected: []expectedChange{{ChangeCancelled, 1, -1}},
+		},
+		{
+			name:     "moved beyond the maximum distance",
+			old:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(1, 8, 0))},
+			new:      []*Class{testClass("Programowanie", "wykład", "dr Nowak", "Aula A", june(16, 8, 0))},
+			expected: []expectedChange{{ChangeCancelled, 0, -1}, {ChangeAdded, -1, 0}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := make([]Class, len(test.old))
+			for i, c := range test.old {
+				snapshot[i] = *c
+			}
+			old := Timetable{Classes: append([]*Class{}, test.old...)}
+
+			diff := old.Diff(Timetable{Classes: test.new})
+
+			if len(old.Classes) != len(test.old) {
+				t.Fatalf("old timetable has %d classes after diffing, expected %d", len(old.Classes), len(test.old))
+			}
+			for i, c := range old.Classes {
+				if c != test.old[i] || !c.Equal(&snapshot[i]) {
+					t.Fatalf("class %d of the old timetable was modified: %+v", i, c)
+				}
+			}
+
+			if len(diff) != len(test.expected) {
+				t.Fatalf("got %d changes, expected %d: %v", len(diff), len(test.expected), diff)
+			}
+			for i, expected := range test.expected {
+				got := diff[i]
+				if got.Kind != expected.kind {
+					t.Errorf("change %d is %s, expected %s", i, got.Kind, expected.kind)
+				}
+				if !samePointer(got.Old, test.old, expected.old) {
+					t.Errorf("change %d pairs old class %+v, expected index %d", i, got.Old, expected.old)
+				}
+				if !samePointer(got.New, test.new, expected.new) {
+					t.Errorf("change %d pairs new class %+v, expected index %d", i, got.New, expected.new)
+				}
+			}
+		})
+	}
+}
+
+func samePointer(got *Class, classes []*Class, index int) bool {
+	if index < 0 {
+		return got == nil
+	}
+	return got == classes[index]
+}
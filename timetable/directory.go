@@ -0,0 +1,57 @@
+package timetable
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// DirectoryEntry is a group, teacher or room published by planzajec
+type DirectoryEntry struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+}
+
+// directory holds scraped ids of one resource type, raw is the category->name->id json it was built from
+type directory struct {
+	raw     []byte
+	entries []DirectoryEntry
+	ids     map[uint]bool
+}
+
+func newDirectory(byt []byte) (*directory, error) {
+	associations := map[string]map[string]int{}
+	if err := json.Unmarshal(byt, &associations); err != nil {
+		return nil, err
+	}
+	dir := &directory{raw: byt, entries: []DirectoryEntry{}, ids: map[uint]bool{}}
+	for category, names := range associations {
+		for name, id := range names {
+			dir.ids[uint(id)] = true
+			dir.entries = append(dir.entries, DirectoryEntry{ID: uint(id), Name: strings.TrimSpace(name), Category: category})
+		}
+	}
+	sort.Slice(dir.entries, func(i, j int) bool {
+		if dir.entries[i].Name == dir.entries[j].Name {
+			return dir.entries[i].ID < dir.entries[j].ID
+		}
+		return dir.entries[i].Name < dir.entries[j].Name
+	})
+	return dir, nil
+}
+
+// Search returns entries whose name or category contains the query, ignoring case. An empty query matches everything.
+func (d *directory) Search(query string) []DirectoryEntry {
+	query = strings.TrimSpace(query)
+	if len(query) == 0 {
+		return d.entries
+	}
+	found := []DirectoryEntry{}
+	for _, entry := range d.entries {
+		if containsFold(entry.Name, query) || containsFold(entry.Category, query) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
@@ -0,0 +1,125 @@
+package timetable
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const dateFormat = "2006-01-02"
+
+var ErrTimetableFilterInvalid = errors.New("invalid filter, dates have to be formatted as YYYY-MM-DD")
+
+// Filter narrows down classes of a timetable, zero fields match everything.
+// Times are wall clock times in LocalZone, like the ones of scraped classes.
+type Filter struct {
+	// From and To limit classes to the ones overlapping the range
+	From    time.Time
+	To      time.Time
+	Type    string
+	Teacher string
+	Room    string
+}
+
+// ParseFilter reads the filter from query parameters: from, to and day (YYYY-MM-DD, to is inclusive) and type, teacher, room (case-insensitive fragments)
+func ParseFilter(query url.Values) (*Filter, error) {
+	filter := &Filter{
+		Type:    strings.TrimSpace(query.Get("type")),
+		Teacher: strings.TrimSpace(query.Get("teacher")),
+		Room:    strings.TrimSpace(query.Get("room")),
+	}
+	if from := query.Get("from"); len(from) > 0 {
+		parsed, err := time.Parse(dateFormat, from)
+		if err != nil {
+			return nil, ErrTimetableFilterInvalid
+		}
+		filter.From = parsed
+	}
+	if to := query.Get("to"); len(to) > 0 {
+		parsed, err := time.Parse(dateFormat, to)
+		if err != nil {
+			return nil, ErrTimetableFilterInvalid
+		}
+		filter.To = parsed.AddDate(0, 0, 1)
+	}
+	if day := query.Get("day"); len(day) > 0 {
+		parsed, err := time.Parse(dateFormat, day)
+		if err != nil {
+			return nil, ErrTimetableFilterInvalid
+		}
+		filter.From = parsed
+		filter.To = parsed.AddDate(0, 0, 1)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		return nil, ErrTimetableFilterInvalid
+	}
+	return filter, nil
+}
+
+// Match reports whether the class passes the filter
+func (f *Filter) Match(class *Class) bool {
+	if !f.From.IsZero() && !class.End.After(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !class.Start.Before(f.To) {
+		return false
+	}
+	return containsFold(class.Type, f.Type) && containsFold(class.Teacher, f.Teacher) && containsFold(class.Room, f.Room)
+}
+
+// Filter returns a copy of the timetable with only the matching classes, the timetable itself is not modified
+func (tt *Timetable) Filter(f *Filter) *Timetable {
+	filtered := &Timetable{GroupID: tt.GroupID, Group: tt.Group, Classes: []*Class{}}
+	for _, class := range tt.Classes {
+		if f.Match(class) {
+			filtered.Classes = append(filtered.Classes, class)
+		}
+	}
+	return filtered
+}
+
+// Next returns the first class starting after the time which passes the filter, or nil if there's none
+func (tt *Timetable) Next(after time.Time, f *Filter) *Class {
+	var next *Class
+	for _, class := range tt.Classes {
+		if !class.Start.After(after) || !f.Match(class) {
+			continue
+		}
+		if next == nil || class.Start.Before(next.Start) {
+			next = class
+		}
+	}
+	return next
+}
+
+// LocalNow returns the current wall clock time in LocalZone, comparable with times of scraped classes
+func LocalNow() time.Time {
+	now := time.Now().In(localZone())
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+}
+
+// Today returns the start of the current day in LocalZone
+func Today() time.Time {
+	now := LocalNow()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// WeekStart returns Monday of the current week in LocalZone
+func WeekStart() time.Time {
+	today := Today()
+	// weeks start on Monday in Poland
+	return today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+}
+
+// localZone returns LocalZone, or the local zone of the server if it's not available
+func localZone() *time.Location {
+	if loc, err := time.LoadLocation(LocalZone); err == nil {
+		return loc
+	}
+	return time.Local
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
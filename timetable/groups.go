@@ -16,7 +16,24 @@ const delay = 500 * time.Millisecond
 
 var idRegexp = regexp.MustCompile("id=(\\d+)")
 
+// ResourceType is the kind of plans published by planzajec, it's the typ parameter of its urls
+type ResourceType string
+
+const (
+	ResourceGroup   ResourceType = "G"
+	ResourceTeacher ResourceType = "N"
+	ResourceRoom    ResourceType = "S"
+)
+
+// ResourceTypes lists all the scraped resource types
+var ResourceTypes = []ResourceType{ResourceGroup, ResourceTeacher, ResourceRoom}
+
 func ScrapeGroupIDs() (associations map[string]map[string]int, err error) {
+	return ScrapeIDs(ResourceGroup)
+}
+
+// ScrapeIDs gathers ids of all resources of the type, grouped by category and name
+func ScrapeIDs(kind ResourceType) (associations map[string]map[string]int, err error) {
 	associations = map[string]map[string]int{}
 	doc, err := goquery.NewDocument(basePath)
 	if err != nil {
@@ -24,7 +41,7 @@ func ScrapeGroupIDs() (associations map[string]map[string]int, err error) {
 	}
 	doc.Find(".kategorie > a").EachWithBreak(func(i int, sel *goquery.Selection) bool {
 		categoryURL, ok := sel.Attr("href")
-		if !ok || !strings.Contains(categoryURL, "typ=G") {
+		if !ok || !strings.Contains(categoryURL, "typ="+string(kind)) {
 			return true
 		}
 		categoryURL = basePath + categoryURL
@@ -42,7 +59,12 @@ func ScrapeGroupIDs() (associations map[string]map[string]int, err error) {
 		subDoc.Find(".kolumny a").EachWithBreak(func(i int, sel *goquery.Selection) bool {
 			name := sel.Text()
 			if rawID, ok := sel.Attr("href"); ok {
-				if parsed, iErr := strconv.Atoi(idRegexp.FindStringSubmatch(rawID)[1]); iErr == nil {
+				match := idRegexp.FindStringSubmatch(rawID)
+				if len(match) < 2 {
+					err = errors.New("timetable format might have changed")
+					return false
+				}
+				if parsed, iErr := strconv.Atoi(match[1]); iErr == nil {
 					associations[groupName][name] = parsed
 				} else {
 					err = iErr
@@ -55,5 +77,5 @@ func ScrapeGroupIDs() (associations map[string]map[string]int, err error) {
 		})
 		return err == nil
 	})
-	return associations, nil
+	return associations, err
 }
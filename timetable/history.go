@@ -0,0 +1,103 @@
+package timetable
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/maciekmm/uek-bruschetta/models"
+	"github.com/maciekmm/uek-bruschetta/utils"
+)
+
+// HandleGetChanges lists changes of the group's timetable detected since the given time (RFC 3339 or YYYY-MM-DD), or over the whole period
+func (c *Coordinator) HandleGetChanges(rw http.ResponseWriter, r *http.Request) {
+	group, err := strconv.Atoi(mux.Vars(r)["group"])
+	if err != nil {
+		utils.NewErrorResponse(ErrTimetableNoGroupId).Write(http.StatusBadRequest, rw)
+		return
+	}
+	query := r.URL.Query()
+	period := DefaultPeriod
+	if p, err := strconv.Atoi(query.Get("period")); err == nil && p > 0 {
+		period = uint(p)
+	}
+	since := time.Time{}
+	if raw := query.Get("since"); len(raw) > 0 {
+		if since, err = time.Parse(time.RFC3339, raw); err != nil {
+			if since, err = time.ParseInLocation(dateFormat, raw, localZone()); err != nil {
+				utils.NewErrorResponse(ErrTimetableSinceInvalid).Write(http.StatusBadRequest, rw)
+				return
+			}
+		}
+	}
+
+	changes, err := models.TimetableChanges(c.Database, uint(group), period, since)
+	if err != nil {
+		(&utils.ErrorResponse{
+			Errors:      []string{ErrTimetableUnknown.Error()},
+			DebugErrors: []string{err.Error()},
+		}).Write(http.StatusInternalServerError, rw)
+		return
+	}
+	c.write(rw, changes)
+}
+
+// recordBaseline stores the timetable as the first version unless some version is stored already
+func (c *Coordinator) recordBaseline(tt *Timetable, period uint) error {
+	exists, err := models.HasTimetableSnapshot(c.Database, tt.GroupID, period)
+	if err != nil || exists {
+		return err
+	}
+	return c.recordVersion(tt, period, TimetableDiff{})
+}
+
+// recordVersion stores the timetable as a new version along with the changes which led to it
+func (c *Coordinator) recordVersion(tt *Timetable, period uint, diff TimetableDiff) error {
+	classes, err := json.Marshal(tt.Classes)
+	if err != nil {
+		return err
+	}
+	changes, err := timetableChanges(diff)
+	if err != nil {
+		return err
+	}
+	snapshot := &models.TimetableSnapshot{
+		Group:     tt.GroupID,
+		Period:    period,
+		CreatedAt: time.Now(),
+		Classes:   classes,
+	}
+	return models.RecordTimetableVersion(c.Database, snapshot, changes)
+}
+
+// timetableChanges converts the diff into stored changes
+func timetableChanges(diff TimetableDiff) ([]models.TimetableChange, error) {
+	changes := make([]models.TimetableChange, 0, len(diff))
+	for _, d := range diff {
+		change := models.TimetableChange{Kind: string(d.Kind)}
+		var err error
+		if change.Old, err = marshalClass(d.Old); err != nil {
+			return nil, err
+		}
+		if change.New, err = marshalClass(d.New); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// marshalClass encodes the class, a nil class is stored as SQL NULL
+func marshalClass(class *Class) (*json.RawMessage, error) {
+	if class == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(class)
+	if err != nil {
+		return nil, err
+	}
+	message := json.RawMessage(raw)
+	return &message, nil
+}
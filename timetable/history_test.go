@@ -0,0 +1,52 @@
+package timetable
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+)
+
+// driverValue converts a stored class the way database/sql does before handing it to the driver
+func driverValue(t *testing.T, raw *json.RawMessage) driver.Value {
+	value, err := driver.DefaultParameterConverter.ConvertValue(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func assertStoredClass(t *testing.T, raw *json.RawMessage, expected *Class) {
+	value, ok := driverValue(t, raw).([]byte)
+	if !ok {
+		t.Fatalf("class %+v is sent as %#v", expected, driverValue(t, raw))
+	}
+	class := &Class{}
+	if err := json.Unmarshal(value, class); err != nil || !class.Equal(expected) {
+		t.Errorf("class %+v is stored as %s", expected, value)
+	}
+}
+
+// TestTimetableChangesNull records a diff with a cancelled and an added class, the missing class of each change
+// has to reach the driver as nil so that it's stored as NULL rather than an invalid empty jsonb value
+func TestTimetableChangesNull(t *testing.T) {
+	cancelled := testClass("Bazy danych", "ćwiczenia", "mgr Kowalski", "Paw.C 305", june(12, 9, 45))
+	added := testClass("Statystyka", "ćwiczenia", "dr Zając", "Paw.D 12", june(13, 11, 30))
+	old := Timetable{Classes: []*Class{cancelled}}
+
+	changes, err := timetableChanges(old.Diff(Timetable{Classes: []*Class{added}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Kind != string(ChangeCancelled) || changes[1].Kind != string(ChangeAdded) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+
+	assertStoredClass(t, changes[0].Old, cancelled)
+	if value := driverValue(t, changes[0].New); value != nil {
+		t.Errorf("new class of the cancelled change is sent as %#v, expected NULL", value)
+	}
+	if value := driverValue(t, changes[1].Old); value != nil {
+		t.Errorf("old class of the added change is sent as %#v, expected NULL", value)
+	}
+	assertStoredClass(t, changes[1].New, added)
+}
@@ -0,0 +1,172 @@
+package timetable
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icalDateFormat = "20060102T150405"
+	// icalLineLength is the maximum length of a content line in octets, longer lines are folded
+	icalLineLength = 75
+	// LocalZone is the zone of the university, scraped class times are wall clock times in it
+	LocalZone = "Europe/Warsaw"
+)
+
+// vtimezone describes LocalZone for clients which don't know it, using the EU rules for summer time
+const vtimezone = `BEGIN:VTIMEZONE
+TZID:Europe/Warsaw
+BEGIN:DAYLIGHT
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+DTSTART:19700329T020000
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+END:DAYLIGHT
+BEGIN:STANDARD
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+DTSTART:19701025T030000
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU
+END:STANDARD
+END:VTIMEZONE`
+
+var icalEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n")
+
+// Calendar is an RFC 5545 calendar, it's used for feeds of classes and events
+type Calendar struct {
+	Name   string
+	Events []CalendarEvent
+}
+
+// CalendarEvent is a single VEVENT of the calendar
+type CalendarEvent struct {
+	UID   string
+	Start time.Time
+	End   time.Time
+	// Local is set for wall clock times in LocalZone, other times are written in UTC
+	Local       bool
+	Summary     string
+	Location    string
+	Description string
+	Categories  []string
+	Modified    time.Time
+}
+
+// CalendarEvents converts classes of the timetable into calendar events with stable identifiers
+func (tt *Timetable) CalendarEvents() []CalendarEvent {
+	events := make([]CalendarEvent, 0, len(tt.Classes))
+	for _, class := range tt.Classes {
+		group := class.GroupID
+		if group == 0 {
+			group = tt.GroupID
+		}
+
+		summary := class.Class
+		if len(class.Type) > 0 {
+			summary += " (" + class.Type + ")"
+		}
+		description := []string{}
+		if len(class.Teacher) > 0 {
+			description = append(description, class.Teacher)
+		}
+		if len(class.Note) > 0 {
+			description = append(description, class.Note)
+		}
+		event := CalendarEvent{
+			UID:         fmt.Sprintf("class-%d-%s-%08x@uek-bruschetta", group, class.Start.Format(icalDateFormat), crc32.ChecksumIEEE([]byte(class.Class))),
+			Start:       class.Start,
+			End:         class.End,
+			Local:       true,
+			Summary:     summary,
+			Location:    class.Room,
+			Description: strings.Join(description, "\n"),
+		}
+		if len(class.Type) > 0 {
+			event.Categories = []string{class.Type}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// WriteTo writes the calendar in the iCalendar format
+func (c *Calendar) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	line := func(format string, args ...interface{}) {
+		writeICalLine(buf, fmt.Sprintf(format, args...))
+	}
+	stamp := time.Now().UTC().Format(icalDateFormat) + "Z"
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//uek-bruschetta//timetable//PL")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	if len(c.Name) > 0 {
+		line("X-WR-CALNAME:%s", icalEscaper.Replace(c.Name))
+	}
+	line("X-WR-TIMEZONE:%s", LocalZone)
+	for _, l := range strings.Split(vtimezone, "\n") {
+		line("%s", l)
+	}
+
+	for _, event := range c.Events {
+		line("BEGIN:VEVENT")
+		line("UID:%s", event.UID)
+		line("DTSTAMP:%s", stamp)
+		if event.Local {
+			line("DTSTART;TZID=%s:%s", LocalZone, event.Start.Format(icalDateFormat))
+			line("DTEND;TZID=%s:%s", LocalZone, event.End.Format(icalDateFormat))
+		} else {
+			line("DTSTART:%sZ", event.Start.UTC().Format(icalDateFormat))
+			if !event.End.IsZero() {
+				line("DTEND:%sZ", event.End.UTC().Format(icalDateFormat))
+			}
+		}
+		if !event.Modified.IsZero() {
+			line("LAST-MODIFIED:%sZ", event.Modified.UTC().Format(icalDateFormat))
+		}
+		line("SUMMARY:%s", icalEscaper.Replace(event.Summary))
+		if len(event.Location) > 0 {
+			line("LOCATION:%s", icalEscaper.Replace(event.Location))
+		}
+		if len(event.Description) > 0 {
+			line("DESCRIPTION:%s", icalEscaper.Replace(event.Description))
+		}
+		if len(event.Categories) > 0 {
+			categories := make([]string, len(event.Categories))
+			for i, category := range event.Categories {
+				categories[i] = icalEscaper.Replace(category)
+			}
+			line("CATEGORIES:%s", strings.Join(categories, ","))
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.WriteTo(w)
+}
+
+// writeICalLine folds the content line into chunks of at most 75 octets without splitting multi-byte characters
+func writeICalLine(buf *bytes.Buffer, line string) {
+	limit := icalLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// the leading space counts towards the length of continuation lines
+		limit = icalLineLength - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
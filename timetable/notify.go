@@ -0,0 +1,114 @@
+package timetable
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/lib/pq"
+	"github.com/maciekmm/uek-bruschetta/models"
+)
+
+// Affects reports whether the change concerns a class covered by the selections, users without selections attend all classes
+func (cd ClassDiff) Affects(selections []models.ClassSelection) bool {
+	for _, class := range []*Class{cd.Old, cd.New} {
+		if class != nil && class.Attended(selections) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attended reports whether the class is covered by the selections, users without selections attend all classes
+func (c *Class) Attended(selections []models.ClassSelection) bool {
+	if len(selections) == 0 {
+		return true
+	}
+	for _, selection := range selections {
+		if selection.Matches(c.Class, c.Type, c.Teacher) {
+			return true
+		}
+	}
+	return false
+}
+
+// audience is a set of members affected by the same changes
+type audience struct {
+	diff  TimetableDiff
+	users pq.Int64Array
+}
+
+// notifyChanges sends members of the group the changes of classes they attend at high priority,
+// the remaining members get all the changes at low priority unless they muted them.
+// If every member is affected by every change a single event is sent to the whole group.
+func (c *Coordinator) notifyChanges(group uint, diff TimetableDiff) error {
+	members, err := models.GroupMembers(c.Database, group)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	selections, err := models.GroupClassSelections(c.Database, ids)
+	if err != nil {
+		return err
+	}
+
+	audiences := map[string]*audience{}
+	order := []string{}
+	bystanders := pq.Int64Array{}
+	for _, member := range members {
+		affected := TimetableDiff{}
+		key := ""
+		for i, d := range diff {
+			if d.Affects(selections[member.ID]) {
+				affected = append(affected, d)
+				key += strconv.Itoa(i) + ","
+			}
+		}
+		if len(affected) == 0 {
+			if !member.MuteUnselectedChanges {
+				bystanders = append(bystanders, int64(member.ID))
+			}
+			continue
+		}
+		if _, ok := audiences[key]; !ok {
+			audiences[key] = &audience{diff: affected, users: pq.Int64Array{}}
+			order = append(order, key)
+		}
+		audiences[key].users = append(audiences[key].users, int64(member.ID))
+	}
+
+	if len(members) == 0 || (len(order) == 1 && len(audiences[order[0]].diff) == len(diff) && len(audiences[order[0]].users) == len(members)) {
+		return c.sendChanges(group, diff, models.EventPriorityHigh, nil)
+	}
+	for _, key := range order {
+		if err := c.sendChanges(group, audiences[key].diff, models.EventPriorityHigh, audiences[key].users); err != nil {
+			return err
+		}
+	}
+	if len(bystanders) > 0 {
+		return c.sendChanges(group, diff, models.EventPriorityLow, bystanders)
+	}
+	return nil
+}
+
+// sendChanges creates a timetable change event of the group, users narrow down its audience unless empty
+func (c *Coordinator) sendChanges(group uint, diff TimetableDiff, pri models.EventPriority, users pq.Int64Array) error {
+	event := &models.Event{
+		Group:               &group,
+		Name:                "Zmiana w planie zajęć!",
+		NotificationMessage: "Zapoznaj się z nowym planem zajęć.",
+		Description:         diff.String(),
+		Priority:            &pri,
+		Users:               users,
+	}
+	if pri < models.EventPriorityHigh {
+		event.Name = "Zmiana w planie zajęć grupy"
+		event.NotificationMessage = "Zmiany nie dotyczą wybranych przez Ciebie zajęć."
+	}
+	if changes, err := json.Marshal(diff); err == nil {
+		event.Payload = &models.EventPayload{Kind: models.EventPayloadTimetableChange, Changes: changes}
+	}
+	return event.Add(c.Database, c.EventPipe)
+}
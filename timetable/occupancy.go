@@ -0,0 +1,171 @@
+package timetable
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// occupancyLongevity is how long scraped room timetables are used before they are fetched again
+	occupancyLongevity = 24 * time.Hour
+	// occupancyInterval is how often the occupancy index is checked for being outdated
+	occupancyInterval = time.Hour
+	// freeRoomDefaultDuration is the range searched if no end is given, it's the length of a class
+	freeRoomDefaultDuration = 90 * time.Minute
+	freeRoomMaximumRange    = 31 * 24 * time.Hour
+	localTimeFormat         = "2006-01-02T15:04"
+)
+
+var (
+	ErrFreeRoomRangeInvalid    = errors.New("invalid range, times have to be formatted as YYYY-MM-DDTHH:MM and span at most 31 days")
+	ErrFreeRoomDurationInvalid = errors.New("invalid duration, it has to be a positive number of minutes")
+	ErrOccupancyNotReady       = errors.New("room occupancy is not known yet, try again later")
+)
+
+// Interval is a span of wall clock time in LocalZone
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// FreeRoom is a room along with its vacant intervals in the searched range
+type FreeRoom struct {
+	DirectoryEntry
+	Free []Interval `json:"free"`
+}
+
+// FreeRoomQuery describes the search, rooms have to be free for at least Duration, or for the whole range if it's zero
+type FreeRoomQuery struct {
+	From     time.Time
+	To       time.Time
+	Building string
+	Duration time.Duration
+}
+
+// occupancy indexes busy intervals of every room, they are sorted by start and don't overlap
+type occupancy struct {
+	builtAt time.Time
+	rooms   []roomSchedule
+}
+
+type roomSchedule struct {
+	room DirectoryEntry
+	busy []Interval
+}
+
+// ParseFreeRoomQuery reads from, to (YYYY-MM-DDTHH:MM), building and duration (minutes) from query parameters.
+// The range starts now and lasts 90 minutes by default.
+func ParseFreeRoomQuery(query url.Values) (*FreeRoomQuery, error) {
+	q := &FreeRoomQuery{From: LocalNow(), Building: query.Get("building")}
+	if from := query.Get("from"); len(from) > 0 {
+		parsed, err := time.Parse(localTimeFormat, from)
+		if err != nil {
+			return nil, ErrFreeRoomRangeInvalid
+		}
+		q.From = parsed
+	}
+	q.To = q.From.Add(freeRoomDefaultDuration)
+	if to := query.Get("to"); len(to) > 0 {
+		parsed, err := time.Parse(localTimeFormat, to)
+		if err != nil {
+			return nil, ErrFreeRoomRangeInvalid
+		}
+		q.To = parsed
+	}
+	if !q.To.After(q.From) || q.To.Sub(q.From) > freeRoomMaximumRange {
+		return nil, ErrFreeRoomRangeInvalid
+	}
+	if duration := query.Get("duration"); len(duration) > 0 {
+		minutes, err := strconv.Atoi(duration)
+		if err != nil || minutes <= 0 {
+			return nil, ErrFreeRoomDurationInvalid
+		}
+		q.Duration = time.Duration(minutes) * time.Minute
+	}
+	return q, nil
+}
+
+func newOccupancy(rooms []DirectoryEntry, timetables map[uint]*Timetable) *occupancy {
+	occ := &occupancy{builtAt: time.Now(), rooms: make([]roomSchedule, 0, len(rooms))}
+	for _, room := range rooms {
+		tt, ok := timetables[room.ID]
+		if !ok {
+			// rooms which couldn't be fetched are left out rather than reported as free
+			continue
+		}
+		busy := make([]Interval, 0, len(tt.Classes))
+		for _, class := range tt.Classes {
+			busy = append(busy, Interval{Start: class.Start, End: class.End})
+		}
+		occ.rooms = append(occ.rooms, roomSchedule{room: room, busy: mergeIntervals(busy)})
+	}
+	return occ
+}
+
+// Free finds rooms with vacant intervals matching the query, sorted by name
+func (o *occupancy) Free(q *FreeRoomQuery) []FreeRoom {
+	required := q.Duration
+	if required == 0 || required > q.To.Sub(q.From) {
+		required = q.To.Sub(q.From)
+	}
+
+	found := []FreeRoom{}
+	for _, schedule := range o.rooms {
+		if len(q.Building) > 0 && !containsFold(schedule.room.Category, q.Building) && !containsFold(schedule.room.Name, q.Building) {
+			continue
+		}
+		free := []Interval{}
+		for _, gap := range schedule.gaps(q.From, q.To) {
+			if gap.End.Sub(gap.Start) >= required {
+				free = append(free, gap)
+			}
+		}
+		if len(free) > 0 {
+			found = append(found, FreeRoom{DirectoryEntry: schedule.room, Free: free})
+		}
+	}
+	return found
+}
+
+// gaps returns vacant intervals of the room within the range
+func (s *roomSchedule) gaps(from, to time.Time) []Interval {
+	// the first class which ends after the range starts, earlier ones don't matter
+	i := sort.Search(len(s.busy), func(i int) bool {
+		return s.busy[i].End.After(from)
+	})
+	gaps := []Interval{}
+	cursor := from
+	for ; i < len(s.busy) && s.busy[i].Start.Before(to); i++ {
+		if s.busy[i].Start.After(cursor) {
+			gaps = append(gaps, Interval{Start: cursor, End: s.busy[i].Start})
+		}
+		if s.busy[i].End.After(cursor) {
+			cursor = s.busy[i].End
+		}
+	}
+	if cursor.Before(to) {
+		gaps = append(gaps, Interval{Start: cursor, End: to})
+	}
+	return gaps
+}
+
+// mergeIntervals sorts the intervals and joins the overlapping ones
+func mergeIntervals(intervals []Interval) []Interval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].Start.Before(intervals[j].Start)
+	})
+	merged := []Interval{}
+	for _, interval := range intervals {
+		if last := len(merged) - 1; last >= 0 && !interval.Start.After(merged[last].End) {
+			if interval.End.After(merged[last].End) {
+				merged[last].End = interval.End
+			}
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
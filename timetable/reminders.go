@@ -0,0 +1,95 @@
+package timetable
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/maciekmm/uek-bruschetta/models"
+)
+
+// reminderInterval is how often upcoming classes are checked for reminders
+const reminderInterval = time.Minute
+
+// runReminders sends reminders of upcoming classes on every tick of the reminder ticker
+func (c *Coordinator) runReminders() {
+	c.remindedUntil = LocalNow()
+	for range c.reminderTicker.C {
+		if err := c.sendReminders(); err != nil {
+			c.Logger.Printf("could not send class reminders: %s\n", err.Error())
+		}
+	}
+}
+
+// sendReminders reminds users of classes starting within their lead time since the previous run,
+// cancelled classes and classes the user didn't select are skipped.
+// If recipients can't be loaded the classes are reminded of on the next run.
+func (c *Coordinator) sendReminders() error {
+	now := LocalNow()
+	since := c.remindedUntil
+
+	users, err := models.ReminderRecipients(c.Database)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	selections, err := models.GroupClassSelections(c.Database, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		groups := user.AllGroups()
+		if len(groups) == 0 {
+			continue
+		}
+		tt, err := c.LoadMerged(groups, DefaultPeriod)
+		if err != nil {
+			c.Logger.Printf("could not load timetable of user %d for reminders: %s\n", user.ID, err.Error())
+			continue
+		}
+		lead := time.Duration(user.ReminderMinutes) * time.Minute
+		for _, class := range tt.Classes {
+			if !class.Start.After(since.Add(lead)) || class.Start.After(now.Add(lead)) {
+				continue
+			}
+			if class.Cancelled() || !class.Attended(selections[user.ID]) {
+				continue
+			}
+			if err := c.remind(user.ID, class); err != nil {
+				c.Logger.Printf("could not remind user %d of a class: %s\n", user.ID, err.Error())
+			}
+		}
+	}
+	c.remindedUntil = now
+	return nil
+}
+
+// remind sends the user a reminder of the class, urgent classes are reminded of at high priority
+func (c *Coordinator) remind(userID uint, class *Class) error {
+	pri := models.EventPriorityMedium
+	if class.Urgent {
+		pri = models.EventPriorityHigh
+	}
+	message := fmt.Sprintf("%s, %s, %s", class.Start.Format("15:04"), class.Type, class.Room)
+	description := class.String()
+	if len(class.Note) > 0 {
+		message += " (" + class.Note + ")"
+		description += "\n" + class.Note
+	}
+	event := &models.Event{
+		Name:                "Za chwilę: " + class.Class,
+		NotificationMessage: message,
+		Description:         description,
+		Priority:            &pri,
+		Users:               pq.Int64Array{int64(userID)},
+	}
+	if raw, err := json.Marshal([]*Class{class}); err == nil {
+		event.Payload = &models.EventPayload{Kind: models.EventPayloadClassReminder, Classes: raw}
+	}
+	return event.Add(c.Database, c.EventPipe)
+}
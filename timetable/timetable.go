@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +19,9 @@ var hourExpression = regexp.MustCompile("[\\d]{2}:[\\d]{2}")
 
 const timeFormat = "2006-01-02 15:04"
 
+// cancellationMarkers are fragments the timetable uses to mark cancelled classes
+var cancellationMarkers = []string{"odwołan", "przeniesienie zajęć"}
+
 type ParsingError struct {
 	Errors []error
 }
@@ -31,9 +35,11 @@ func (pe *ParsingError) Error() string {
 }
 
 type Timetable struct {
-	GroupID uint     `json:"group_id"`
-	Group   string   `json:"group"`
-	Classes []*Class `json:"classes"`
+	// GroupID and Group are the id and name of the resource, which is a group unless Type says otherwise
+	GroupID uint         `json:"group_id"`
+	Group   string       `json:"group"`
+	Type    ResourceType `json:"type,omitempty"`
+	Classes []*Class     `json:"classes"`
 }
 
 type Class struct {
@@ -45,22 +51,89 @@ type Class struct {
 	Room    string    `json:"room,omitempty"`
 	Note    string    `json:"note,omitempty"`
 	Urgent  bool      `json:"urgent,omitempty"`
+	// Groups attending the class are only listed in teacher and room timetables
+	Groups string `json:"groups,omitempty"`
+	// GroupID is only set in merged timetables
+	GroupID uint `json:"group_id,omitempty"`
 }
 
 func (c *Class) String() string {
 	return fmt.Sprintf("%s - %s: %s - %s (%s) w %s", c.Start.Format(timeFormat), c.End.Format(timeFormat), c.Type, c.Class, c.Teacher, c.Room)
 }
 
+// Cancelled reports whether the class is marked as cancelled or moved away in its type or notes
+func (c *Class) Cancelled() bool {
+	for _, marker := range cancellationMarkers {
+		if containsFold(c.Type, marker) || containsFold(c.Note, marker) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Class) Valid() bool {
 	return !c.Start.IsZero() && !c.End.IsZero() && len(c.Class) > 0
 }
 
 func (c *Class) Equal(new *Class) bool {
-	return c.Start.Equal(new.Start) && c.End.Equal(new.End) && c.Class == new.Class && c.Type == new.Type && c.Teacher == new.Teacher && c.Room == new.Room && c.Note == new.Note
+	return c.Start.Equal(new.Start) && c.End.Equal(new.End) && c.Class == new.Class && c.Type == new.Type && c.Teacher == new.Teacher && c.Room == new.Room && c.Note == new.Note && c.Groups == new.Groups
+}
+
+// Merge combines timetables of several groups into one sorted by start time, classes shared by the groups are listed once.
+// The merged timetable is identified by the first group, the timetables themselves are not modified.
+func Merge(timetables ...*Timetable) *Timetable {
+	merged := &Timetable{Classes: []*Class{}}
+	names := []string{}
+	for i, tt := range timetables {
+		if i == 0 {
+			merged.GroupID = tt.GroupID
+		}
+		names = append(names, tt.Group)
+	outer:
+		for _, class := range tt.Classes {
+			for _, existing := range merged.Classes {
+				if existing.Equal(class) {
+					continue outer
+				}
+			}
+			copied := *class
+			copied.GroupID = tt.GroupID
+			merged.Classes = append(merged.Classes, &copied)
+		}
+	}
+	merged.Group = strings.Join(names, ", ")
+	sort.SliceStable(merged.Classes, func(i, j int) bool {
+		return merged.Classes[i].Start.Before(merged.Classes[j].Start)
+	})
+	return merged
+}
+
+// columns of plan tables
+const (
+	columnDate = iota
+	columnHours
+	columnClass
+	columnType
+	columnTeacher
+	columnRoom
+	columnGroups
+)
+
+// layouts maps table columns of each resource type, teacher plans list groups instead of the teacher
+// and room plans list groups instead of the room
+var layouts = map[ResourceType][]int{
+	ResourceGroup:   {columnDate, columnHours, columnClass, columnType, columnTeacher, columnRoom},
+	ResourceTeacher: {columnDate, columnHours, columnClass, columnType, columnGroups, columnRoom},
+	ResourceRoom:    {columnDate, columnHours, columnClass, columnType, columnTeacher, columnGroups},
 }
 
 func TimetableFromId(id uint, period uint) (*Timetable, error) {
-	resp, err := http.DefaultClient.Get(fmt.Sprintf("%sindex.php?typ=G&id=%d&okres=%d", basePath, id, period))
+	return FetchTimetable(ResourceGroup, id, period)
+}
+
+// FetchTimetable downloads and parses the plan of the resource
+func FetchTimetable(kind ResourceType, id uint, period uint) (*Timetable, error) {
+	resp, err := http.DefaultClient.Get(fmt.Sprintf("%sindex.php?typ=%s&id=%d&okres=%d", basePath, kind, id, period))
 	if err != nil {
 		return nil, err
 	}
@@ -68,14 +141,26 @@ func TimetableFromId(id uint, period uint) (*Timetable, error) {
 		return nil, errors.New("invalid status code")
 	}
 	defer resp.Body.Close()
-	return ParseTimetable(resp.Body, id)
+	return ParseResourceTimetable(resp.Body, kind, id)
 }
 
 func ParseTimetable(reader io.Reader, id uint) (*Timetable, error) {
+	return ParseResourceTimetable(reader, ResourceGroup, id)
+}
+
+// ParseResourceTimetable parses the plan of a group, teacher or room
+func ParseResourceTimetable(reader io.Reader, kind ResourceType, id uint) (*Timetable, error) {
+	layout, ok := layouts[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown resource type: %s", kind)
+	}
 	timetable := &Timetable{
 		Classes: []*Class{},
 		GroupID: id,
 	}
+	if kind != ResourceGroup {
+		timetable.Type = kind
+	}
 	errs := []error{}
 	doc, err := goquery.NewDocumentFromReader(reader)
 	if err != nil {
@@ -101,12 +186,15 @@ func ParseTimetable(reader io.Reader, id uint) (*Timetable, error) {
 				return false
 			}
 
-			switch j {
+			if j >= len(layout) {
+				return true
+			}
+			switch layout[j] {
 			//termin
-			case 0:
+			case columnDate:
 				termin = strings.TrimSpace(sel.Text())
 			//godzina
-			case 1:
+			case columnHours:
 				hours := hourExpression.FindAllString(sel.Text(), -1)
 				if len(hours) != 2 {
 					errs = append(errs, fmt.Errorf("invalid hours field: %s", sel.Text()))
@@ -125,14 +213,16 @@ func ParseTimetable(reader io.Reader, id uint) (*Timetable, error) {
 				}
 				class.End = parsed
 			//przedmiot
-			case 2:
+			case columnClass:
 				class.Class = strings.TrimSpace(sel.Text())
-			case 3:
+			case columnType:
 				class.Type = strings.TrimSpace(sel.Text())
-			case 4:
+			case columnTeacher:
 				class.Teacher = strings.TrimSpace(sel.Text())
-			case 5:
+			case columnRoom:
 				class.Room = strings.TrimSpace(sel.Text())
+			case columnGroups:
+				class.Groups = strings.TrimSpace(sel.Text())
 			}
 
 			return true
@@ -146,64 +236,3 @@ func ParseTimetable(reader io.Reader, id uint) (*Timetable, error) {
 	}
 	return timetable, nil
 }
-
-type TimetableDiff []ClassDiff
-
-func (td TimetableDiff) String() string {
-	message := ""
-	for _, d := range td {
-		message += d.String()
-		message += "\n\n"
-	}
-	return message
-}
-
-type ClassDiff struct {
-	Old *Class `json:"old"`
-	New *Class `json:"new"`
-}
-
-func (cd ClassDiff) String() string {
-	if cd.New == nil {
-		return "Wycofane: " + cd.Old.String()
-	} else if cd.Old == nil {
-		return "Nowe: " + cd.New.String()
-	}
-	return "Zmiana:\n\t" + cd.Old.String() + "\n\tna: " + cd.New.String()
-}
-
-func (old Timetable) Diff(new Timetable) TimetableDiff {
-	diff := []ClassDiff{}
-
-outer:
-	for _, newClass := range new.Classes {
-		for j, oldClass := range old.Classes {
-			if !oldClass.Start.Equal(newClass.Start) {
-				continue
-			}
-			old.Classes = append(old.Classes[:j], old.Classes[j+1:]...)
-
-			if newClass.Equal(oldClass) {
-				continue outer
-			}
-
-			diff = append(diff, ClassDiff{
-				Old: oldClass,
-				New: newClass,
-			})
-			continue outer
-		}
-		// the class is not in the old timetable
-		diff = append(diff, ClassDiff{
-			Old: nil,
-			New: newClass,
-		})
-	}
-	for _, oldClass := range old.Classes {
-		diff = append(diff, ClassDiff{
-			Old: oldClass,
-			New: nil,
-		})
-	}
-	return diff
-}
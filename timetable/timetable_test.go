@@ -0,0 +1,73 @@
+package timetable
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func parseFixture(t *testing.T, name string, kind ResourceType, id uint) *Timetable {
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tt, err := ParseResourceTimetable(file, kind, id)
+	if err != nil {
+		t.Fatalf("could not parse %s: %s", name, err.Error())
+	}
+	return tt
+}
+
+// assertClasses compares classes field by field along with the urgency and cancellation the fixtures mark
+func assertClasses(t *testing.T, got []*Class, expected []*Class, urgent []bool, cancelled []bool) {
+	if len(got) != len(expected) {
+		t.Fatalf("parsed %d classes, expected %d: %v", len(got), len(expected), got)
+	}
+	for i, class := range got {
+		if !class.Equal(expected[i]) {
+			t.Errorf("class %d is %+v, expected %+v", i, class, expected[i])
+		}
+		if class.Urgent != urgent[i] {
+			t.Errorf("class %d urgent is %t, expected %t", i, class.Urgent, urgent[i])
+		}
+		if class.Cancelled() != cancelled[i] {
+			t.Errorf("class %d cancelled is %t, expected %t", i, class.Cancelled(), cancelled[i])
+		}
+	}
+}
+
+func TestParseTeacherTimetable(t *testing.T) {
+	tt := parseFixture(t, "teacher.html", ResourceTeacher, 4411)
+	if tt.GroupID != 4411 || tt.Group != "dr Jan Nowak" || tt.Type != ResourceTeacher {
+		t.Errorf("unexpected teacher timetable %d %q of type %q", tt.GroupID, tt.Group, tt.Type)
+	}
+
+	expected := []*Class{
+		{Start: june(12, 8, 0), End: june(12, 9, 30), Class: "Programowanie obiektowe", Type: "wykład", Room: "Paw.C aula A", Groups: "KrZZIs2011Io, KrZZIs2012Io"},
+		{Start: june(12, 9, 45), End: june(12, 11, 15), Class: "Programowanie obiektowe", Type: "laboratorium", Room: "Paw.C 305 lab", Groups: "KrZZIs2011Io", Note: "Zajęcia w parzyste tygodnie"},
+		{Start: june(13, 11, 30), End: june(13, 13, 0), Class: "Programowanie obiektowe", Type: "Przeniesienie zajęć", Room: "Paw.C 305 lab", Groups: "KrZZIs2012Io"},
+		{Start: june(14, 15, 0), End: june(14, 16, 30), Class: "Bazy danych", Type: "ćwiczenia", Room: "Paw.C 102", Groups: "KrZZIs2011Io"},
+	}
+	assertClasses(t, tt.Classes, expected, []bool{false, false, true, false}, []bool{false, false, true, false})
+}
+
+func TestParseRoomTimetable(t *testing.T) {
+	tt := parseFixture(t, "room.html", ResourceRoom, 1305)
+	if tt.GroupID != 1305 || tt.Group != "Paw.C 305 lab" || tt.Type != ResourceRoom {
+		t.Errorf("unexpected room timetable %d %q of type %q", tt.GroupID, tt.Group, tt.Type)
+	}
+
+	expected := []*Class{
+		{Start: june(12, 9, 45), End: june(12, 11, 15), Class: "Programowanie obiektowe", Type: "laboratorium", Teacher: "dr Jan Nowak", Groups: "KrZZIs2011Io", Note: "Zajęcia w parzyste tygodnie"},
+		{Start: june(12, 13, 15), End: june(12, 14, 45), Class: "Sieci komputerowe", Type: "laboratorium", Teacher: "mgr Anna Wiśniewska", Groups: "KrZZIs3011Io, KrZZIs3012Io"},
+		{Start: june(15, 8, 0), End: june(15, 11, 15), Class: "Systemy operacyjne", Type: "laboratorium", Teacher: "dr inż. Piotr Zając", Groups: "KrZZIs2012Io"},
+	}
+	assertClasses(t, tt.Classes, expected, []bool{false, false, true}, []bool{false, false, false})
+}
+
+func TestParseUnknownResourceType(t *testing.T) {
+	if _, err := ParseResourceTimetable(strings.NewReader("<html></html>"), ResourceType("X"), 1); err == nil {
+		t.Fatal("timetable of an unknown resource type was parsed")
+	}
+}
@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 test vectors, "12345678901234567890" encoded in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// the RFC lists 8 digit codes, these are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Errorf("code at %d is %s, expected %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestCodeLowercaseUnpaddedSecret(t *testing.T) {
+	code, err := Code(strings.ToLower(rfcSecret[:26]), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := Code(rfcSecret[:26], 1)
+	if code != expected {
+		t.Errorf("lowercase secret gives %s, expected %s", code, expected)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := Step(now)
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, _ := Code(rfcSecret, current+offset)
+		step, ok := Validate(rfcSecret, code, now, 1)
+		accepted := offset >= -1 && offset <= 1
+		if ok != accepted {
+			t.Errorf("code %d steps away accepted: %t, expected %t", offset, ok, accepted)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code %d steps away matched step %d, expected %d", offset, step, current+offset)
+		}
+	}
+
+	code, _ := Code(rfcSecret, current)
+	if _, ok := Validate(rfcSecret, code[:3]+" "+code[3:], now, 1); !ok {
+		t.Error("code with a space wasn't accepted")
+	}
+	if _, ok := Validate(rfcSecret, code[:5], now, 1); ok {
+		t.Error("truncated code was accepted")
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := Step(now)
+	code, _ := Code(rfcSecret, current)
+
+	step, ok := Verify(rfcSecret, code, now, 1, current-1)
+	if !ok || step != current {
+		t.Fatalf("fresh code rejected, got step %d", step)
+	}
+	if _, ok := Verify(rfcSecret, code, now, 1, step); ok {
+		t.Error("code was accepted twice")
+	}
+
+	// a code of an earlier step within the window can't be used after a later one
+	previous, _ := Code(rfcSecret, current-1)
+	if _, ok := Verify(rfcSecret, previous, now, 1, current); ok {
+		t.Error("code of an earlier step was accepted after a later one was used")
+	}
+	next, _ := Code(rfcSecret, current+1)
+	if step, ok := Verify(rfcSecret, next, now, 1, current); !ok || step != current+1 {
+		t.Error("code of the next step was rejected after the current one was used")
+	}
+}
@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ClientIP returns the address of the client, X-Forwarded-For is only honored if TRUST_PROXY is set to TRUE
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "TRUE" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
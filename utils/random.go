@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// RandomString returns a url-safe string built from n cryptographically secure random bytes
+func RandomString(n int) (string, error) {
+	byt := make([]byte, n)
+	if _, err := rand.Read(byt); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(byt), nil
+}
+
+// HashToken returns a hex encoded SHA-256 digest of a token, used to store secrets that are only ever compared
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}